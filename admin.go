@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// requireAdmin wraps handler so it is only reachable with admin bearer token.
+// Admin API is disabled if no token is configured.
+func requireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if len(Config.AdminToken) == 0 ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(Config.AdminToken)) != 1 {
+			logNetPrintf(r, "Unauthorized admin request %s\n", r.URL.Path)
+			writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, nil)
+			return
+		}
+
+		h(w, r, ps)
+	}
+}
+
+// audit records admin action in admin_audit table as part of tx
+func audit(tx *sql.Tx, r *http.Request, action string, objectType string, objectID int64, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO admin_audit (
+			created, actor, action, objectType, objectId, data
+		) VALUES (
+			?, ?, ?, ?, ?, ?
+		)`, time.Now().UTC().Unix(), remoteAddr(r), action, objectType, objectID, encoded)
+
+	return err
+}
+
+// paramID parses numeric id router parameter
+func paramID(ps httprouter.Params) (int64, bool) {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+
+	return id, true
+}
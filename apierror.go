@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// Error codes returned to clients in APIError.Code. These are stable, clients
+// should switch on them and not on Message. See README for the list.
+const (
+	ErrCodeBadRequest      = "bad_request"
+	ErrCodeInvalidJSON     = "invalid_json"
+	ErrCodeValidation      = "validation_failed"
+	ErrCodeBodyTooLarge    = "body_too_large"
+	ErrCodeNotFound        = "not_found"
+	ErrCodeUploadClosed    = "upload_closed"
+	ErrCodeQuotaExceeded   = "quota_exceeded"
+	ErrCodeStorageFull     = "storage_full"
+	ErrCodeUnauthorized    = "unauthorized"
+	ErrCodeForbidden       = "forbidden"
+	ErrCodeConflict        = "conflict"
+	ErrCodeRateLimited     = "rate_limited"
+	ErrCodeChallengeFailed = "challenge_failed"
+	ErrCodeInternal        = "internal_error"
+)
+
+var errorMessages = map[string]string{
+	ErrCodeBadRequest:      "Bad request",
+	ErrCodeInvalidJSON:     "Request body is not valid JSON",
+	ErrCodeValidation:      "Request did not pass validation",
+	ErrCodeBodyTooLarge:    "Request body is too large",
+	ErrCodeNotFound:        "Not found",
+	ErrCodeUploadClosed:    "Upload is closed",
+	ErrCodeQuotaExceeded:   "Upload quota exceeded",
+	ErrCodeStorageFull:     "Server storage is full",
+	ErrCodeUnauthorized:    "Unauthorized",
+	ErrCodeForbidden:       "Forbidden",
+	ErrCodeConflict:        "Object is in use or already exists",
+	ErrCodeRateLimited:     "Too many requests, retry later",
+	ErrCodeChallengeFailed: "Proof of work challenge missing or not solved",
+	ErrCodeInternal:        "Internal server error",
+}
+
+// APIError describes why request failed
+type APIError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// ErrorResponse object returned to client on every failed request
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// writeError writes error envelope with given status, code and optional
+// per-field errors
+func writeError(w http.ResponseWriter, status int, code string, fields map[string]string) {
+	response := &ErrorResponse{
+		Error: APIError{
+			Code:    code,
+			Message: errorMessages[code],
+			Fields:  fields,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeInternalError logs err and writes 500 error envelope
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	writeError(w, http.StatusInternalServerError, ErrCodeInternal, nil)
+}
+
+// writeBodyError writes error envelope for error from decodeJSONBody
+func writeBodyError(w http.ResponseWriter, status int, err error) {
+	log.Println(err)
+
+	if status == http.StatusRequestEntityTooLarge {
+		writeError(w, status, ErrCodeBodyTooLarge, nil)
+		return
+	}
+
+	writeError(w, status, ErrCodeInvalidJSON, nil)
+}
+
+// validationFields validates s and returns field path -> message map, nil when s
+// is valid. Paths use JSON names, like "evidences.0.metadata.location.latitude".
+// govalidator names path segments by Go field and loses field name of errors in
+// slice elements, so elements of struct slices are validated one by one here.
+func validationFields(s interface{}) map[string]string {
+	fields := make(map[string]string)
+	collectFieldErrors(reflect.ValueOf(s), "", fields)
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return fields
+}
+
+// collectFieldErrors validates struct v, prefixing field paths with prefix
+func collectFieldErrors(v reflect.Value, prefix string, fields map[string]string) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	_, err := govalidator.ValidateStruct(v.Interface())
+	addFieldErrors(err, v.Type(), prefix, fields)
+
+	collectElementErrors(v, prefix, fields)
+}
+
+// collectElementErrors validates struct elements of slices in v and in structs nested in v
+func collectElementErrors(v reflect.Value, prefix string, fields map[string]string) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+
+		value := v.Field(i)
+		for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+			if value.IsNil() {
+				break
+			}
+			value = value.Elem()
+		}
+
+		switch value.Kind() {
+		case reflect.Struct:
+			collectElementErrors(value, prefix+jsonFieldName(field)+".", fields)
+		case reflect.Slice, reflect.Array:
+			for j := 0; j < value.Len(); j++ {
+				collectFieldErrors(value.Index(j), prefix+jsonFieldName(field)+"."+strconv.Itoa(j)+".", fields)
+			}
+		}
+	}
+}
+
+// addFieldErrors adds govalidator errors of struct type t to fields
+func addFieldErrors(err error, t reflect.Type, prefix string, fields map[string]string) {
+	switch e := err.(type) {
+	case nil:
+	case govalidator.Errors:
+		for _, err := range e.Errors() {
+			addFieldErrors(err, t, prefix, fields)
+		}
+	case govalidator.Error:
+		path, ok := jsonPath(t, e.Path)
+		if !ok {
+			return // error of slice element, reported when element is validated
+		}
+		fields[prefix+strings.Join(append(path, e.Name), ".")] = e.Err.Error()
+	default:
+		fields[prefix+"_"] = err.Error()
+	}
+}
+
+// jsonPath translates govalidator path of Go field names in t to JSON names. It
+// returns false for paths into slice elements, their segments look like "Field.0".
+func jsonPath(t reflect.Type, goPath []string) ([]string, bool) {
+	path := make([]string, 0, len(goPath))
+
+	for _, name := range goPath {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || strings.Contains(name, ".") {
+			return nil, false
+		}
+
+		field, ok := t.FieldByName(name)
+		if !ok {
+			return nil, false
+		}
+
+		path = append(path, jsonFieldName(field))
+		t = field.Type
+	}
+
+	return path, true
+}
+
+// jsonFieldName returns name field has in JSON
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if len(name) == 0 || name == "-" {
+		return field.Name
+	}
+
+	return name
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidationFieldsNestedSliceElement(t *testing.T) {
+	report := &Report{
+		Evidences: []Evidence{
+			{Path: "2f0d1c7e-4d3b-4a8e-9b1a-3f6c2d1e0a9b.jpg"},
+			{
+				Path: "foo.exe",
+				Metadata: Metadata{
+					Location: Location{Latitude: 91},
+				},
+			},
+		},
+		Recipients: []Recipient{{Title: "Editor"}},
+	}
+
+	fields := validationFields(report)
+
+	for _, key := range []string{"evidences.1.path", "evidences.1.metadata.location.latitude"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("missing %q in %v", key, fields)
+		}
+	}
+	if len(fields) != 2 {
+		t.Errorf("expected 2 fields, got %v", fields)
+	}
+}
+
+func TestValidationFieldsSliceFieldName(t *testing.T) {
+	registration := &FormMediaFileRegister{
+		Attachments: []MediaFile{{FileName: "not a file"}},
+	}
+
+	fields := validationFields(registration)
+
+	if !reflect.DeepEqual(keys(fields), []string{"attachments.0.fileName"}) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestValidationFieldsValid(t *testing.T) {
+	fields := validationFields(&FormMediaFileRegister{
+		Attachments: []MediaFile{{FileName: "2f0d1c7e-4d3b-4a8e-9b1a-3f6c2d1e0a9b.mp4"}},
+	})
+
+	if fields != nil {
+		t.Errorf("expected no fields, got %v", fields)
+	}
+}
+
+func keys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
@@ -0,0 +1,37 @@
+package reflectorapp
+
+import (
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// nonceKeyPrefix namespaces token nonces in memcache
+const nonceKeyPrefix = "reflector-nonce:"
+
+// memcacheNonces keeps used token nonces in memcache shared by all instances,
+// memcache.Add stores nonce only when it is not there yet
+type memcacheNonces struct{}
+
+func (memcacheNonces) Add(r *http.Request, nonce string, expires time.Time) (bool, error) {
+	expiration := time.Until(expires)
+	if expiration < time.Second {
+		expiration = time.Second
+	}
+
+	err := memcache.Add(appengine.NewContext(r), &memcache.Item{
+		Key:        nonceKeyPrefix + nonce,
+		Value:      []byte{1},
+		Expiration: expiration,
+	})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -1,126 +1,69 @@
-package reflector
+// Package reflectorapp runs reflector on App Engine, upstream requests are made
+// with urlfetch.
+package reflectorapp
 
 import (
-	"context"
-	"errors"
-	"io"
 	"net/http"
-	"time"
 
+	"github.com/BuildAMovement/whistler-backend/reflector"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/urlfetch"
 )
 
-const (
-	// A timeout of 0 means to use the App Engine default (5 seconds).
-	urlFetchTimeout = 20 * time.Second
-)
+// options are loaded from environment set in app.yaml
+var options *reflector.Options
 
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
-		}
+// transport returns urlfetch transport bound to request context. We use
+// urlfetch.Transport directly instead of urlfetch.Client because we want only
+// a single HTTP transaction, not following redirects.
+func transport(r *http.Request) http.RoundTripper {
+	return &urlfetch.Transport{
+		Context: appengine.NewContext(r),
+		// Despite the name, Transport.Deadline is really a timeout and
+		// not an absolute deadline as used in the net package. In
+		// other words it is a time.Duration, not a time.Time.
+		Deadline: options.UpstreamTimeout,
 	}
 }
 
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
-var stoppedHeaders = map[string]bool{
-	"Whistler-Host":       true,
-	"Connection":          true,
-	"Keep-Alive":          true,
-	"Proxy-Authenticate":  true,
-	"Proxy-Authorization": true,
-	"Te":                true, // canonicalized version of "TE"
-	"Trailers":          true,
-	"Transfer-Encoding": true,
-	"Upgrade":           true,
-}
-
-// Basic client request check
-func checkRequest(r *http.Request) error {
-	/*if r.URL.Path != "/" && r.URL.Path != "" {
-		return errors.New("Non empty path in request")
-	}*/
-
-	return nil
+func logf(r *http.Request, format string, v ...interface{}) {
+	log.Errorf(appengine.NewContext(r), format, v...)
 }
 
-// Make a copy of r, removing the headers in stoppedHeaders, getting next host from header and checking
-// if it is allowed
-func copyRequest(context context.Context, r *http.Request) (*http.Request, error) {
-	fwURL := r.Header.Get("Whistler-Host")
-	if fwURL == "" {
-		return nil, errors.New("No Host header in request")
-	}
-
-	fwURL, err := GetWhistlerURL(fwURL)
+func init() {
+	hosts, err := reflector.LoadHosts()
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
 
-	c, err := http.NewRequest(r.Method, fwURL, r.Body)
+	options, err = reflector.LoadOptions()
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
 
-	for key, values := range r.Header {
-		if stoppedHeaders[key] == false {
-			for _, value := range values {
-				c.Header.Add(key, value)
-			}
-		}
-	}
-
-	return c, nil
-}
+	rf := reflector.New(hosts, transport, logf)
+	rf.Options = *options
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	context := appengine.NewContext(r)
-
-	err := checkRequest(r)
-	if err != nil {
-		log.Errorf(context, "checkRequest: %s", err)
-		http.Error(w, "", http.StatusNotFound)
-		return
+	// front end sets client address, connection comes from Google infrastructure
+	if len(rf.Options.ClientIPHeader) == 0 {
+		rf.Options.ClientIPHeader = "X-Appengine-User-Ip"
 	}
 
-	fr, err := copyRequest(context, r)
+	rf.Auth, err = reflector.LoadAuth()
 	if err != nil {
-		log.Errorf(context, "copyRequest: %s", err)
-		http.Error(w, "", http.StatusBadRequest)
-		return
-	}
-
-	// Use urlfetch.Transport directly instead of urlfetch.Client because we
-	// want only a single HTTP transaction, not following redirects.
-	transport := urlfetch.Transport{
-		Context: context,
-		// Despite the name, Transport.Deadline is really a timeout and
-		// not an absolute deadline as used in the net package. In
-		// other words it is a time.Duration, not a time.Time.
-		///Deadline: urlFetchTimeout, TODO: replace this..
+		panic(err)
 	}
-	resp, err := transport.RoundTrip(fr)
-	if err != nil {
-		log.Errorf(context, "RoundTrip: %s", err)
-		http.Error(w, "", http.StatusInternalServerError)
-		return
+	// instances do not share memory, nonces go to memcache so tokens can not be
+	// replayed on other instance
+	if rf.Auth != nil {
+		rf.Auth.Nonces = memcacheNonces{}
 	}
-	defer resp.Body.Close()
-
-	copyHeader(w.Header(), resp.Header)
 
-	w.WriteHeader(resp.StatusCode)
-
-	_, err = io.Copy(w, resp.Body)
+	rf.Routes, err = reflector.LoadRouteKeys()
 	if err != nil {
-		log.Errorf(context, "io.Copy: %s", err)
+		panic(err)
 	}
-}
 
-func init() {
-	http.HandleFunc("/", handler)
+	http.Handle("/", rf)
 }
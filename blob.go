@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// blobDir is directory under Config.BaseDir holding content addressed files
+const blobDir = "blobs"
+
+// blobPath returns storage path of blob with given sha256 hex hash
+func blobPath(hash string) string {
+	return path.Join(Config.BaseDir, blobDir, hash[:2], hash)
+}
+
+// hashFile returns sha256 hex hash and size of file
+func hashFile(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// insertBlob records blob in database if it is not there yet and locks its row
+// until tx ends, so releaseBlob can not remove blob file while it is being linked
+func insertBlob(tx *sql.Tx, hash string, size int64) error {
+	_, err := tx.Exec(`
+		INSERT IGNORE INTO file_blob (
+			hash, size, created
+		) VALUES (
+			?, ?, ?
+		)`, hash, size, time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+
+	var locked string
+	return tx.QueryRow(`SELECT hash FROM file_blob WHERE hash = ? FOR UPDATE`, hash).Scan(&locked)
+}
+
+// storeBlob moves uploaded file into content addressed storage and records blob
+// in tx. If same bytes are already stored, uploaded file is replaced with link to
+// existing blob, so duplicates take space only once. Uploaded file stays reachable
+// under its uid (as hard link) so continuation info keeps working.
+func storeBlob(tx *sql.Tx, uid string) (string, int64, error) {
+	filePath := path.Join(Config.BaseDir, uid)
+
+	hash, size, err := hashFile(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = insertBlob(tx, hash, size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	blob := blobPath(hash)
+
+	err = os.MkdirAll(path.Dir(blob), 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = os.Link(filePath, blob)
+	if err == nil {
+		return hash, size, nil // new content
+	}
+	if !os.IsExist(err) {
+		return "", 0, err
+	}
+
+	// same content already stored, point upload to existing blob
+	tmp := filePath + ".tmp"
+	os.Remove(tmp)
+
+	err = os.Link(blob, tmp)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = os.Rename(tmp, filePath)
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+
+	return hash, size, nil
+}
+
+// importBlob moves file at filePath into content addressed storage and records
+// blob in tx, file itself is removed
+func importBlob(tx *sql.Tx, filePath string) (string, int64, error) {
+	hash, size, err := hashFile(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = insertBlob(tx, hash, size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	blob := blobPath(hash)
+
+	err = os.MkdirAll(path.Dir(blob), 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = os.Link(filePath, blob)
+	if err != nil && !os.IsExist(err) {
+		return "", 0, err
+	}
+
+	return hash, size, os.Remove(filePath)
+}
+
+// blobReferences counts evidence, media_file, train_module, train_module_version
+// and feedback_attachment rows referencing blob.
+func blobReferences(tx *sql.Tx, hash string) (int64, error) {
+	var refs int64
+
+	row := tx.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM evidence WHERE blobHash = ?) +
+			(SELECT COUNT(*) FROM media_file WHERE blobHash = ?) +
+			(SELECT COUNT(*) FROM train_module WHERE packageHash = ?) +
+			(SELECT COUNT(*) FROM train_module_version WHERE packageHash = ?) +
+			(SELECT COUNT(*) FROM feedback_attachment WHERE blobHash = ?)`, hash, hash, hash, hash, hash)
+	err := row.Scan(&refs)
+	if err != nil {
+		return 0, err
+	}
+
+	return refs, nil
+}
+
+// releaseBlob removes blob from storage if nothing references it anymore. It must
+// be called after rows referencing the blob are deleted, and after transaction
+// which stored blob is rolled back, then file without row is removed.
+func releaseBlob(hash string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock blob row (or its absence) so no new reference is made while we count
+	var locked string
+	err = tx.QueryRow(`SELECT hash FROM file_blob WHERE hash = ? FOR UPDATE`, hash).Scan(&locked)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil {
+		refs, err := blobReferences(tx, hash)
+		if err != nil {
+			return err
+		}
+
+		if refs > 0 {
+			return nil
+		}
+
+		_, err = tx.Exec(`DELETE FROM file_blob WHERE hash = ?`, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	// file is moved aside while row is locked, so blob stored right after commit
+	// gets new file, and removed only when delete is committed
+	blob := blobPath(hash)
+	deleted := blob + ".deleted"
+
+	err = os.Rename(blob, deleted)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		os.Rename(deleted, blob)
+		return err
+	}
+
+	err = os.Remove(deleted)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// releaseBlobs releases each blob, logging failures. Transaction which stored
+// them must be finished first, else releaseBlob waits for its row locks.
+func releaseBlobs(hashes ...string) {
+	for _, hash := range hashes {
+		err := releaseBlob(hash)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// uploadReferences counts evidence and media_file rows with uid
+func uploadReferences(tx *sql.Tx, uid string) (int64, error) {
+	var refs int64
+
+	row := tx.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM evidence WHERE uid = ?) +
+			(SELECT COUNT(*) FROM media_file WHERE uid = ?)`, uid, uid)
+	err := row.Scan(&refs)
+	if err != nil {
+		return 0, err
+	}
+
+	return refs, nil
+}
+
+// removeUpload deletes file uploaded under uid when no evidence or media_file row
+// has that uid anymore. Its blob is released separately with releaseBlob.
+func removeUpload(uid string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	refs, err := uploadReferences(tx, uid)
+	if err != nil || refs > 0 {
+		return err
+	}
+
+	err = os.Remove(path.Join(Config.BaseDir, uid))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// completeUpload stores file uploaded under uid as blob and marks all rows in table
+// with that uid with state and blob hash. It returns number of affected rows.
+func completeUpload(table string, uid string, state int8) (int64, error) {
+	var hash sql.NullString
+
+	_, err := os.Stat(path.Join(Config.BaseDir, uid))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	exists := err == nil
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if exists {
+		hash.String, _, err = storeBlob(tx, uid)
+		if err != nil {
+			return 0, err
+		}
+		hash.Valid = true
+	}
+
+	// blob file linked by rolled back transaction has no row, release removes it
+	committed := false
+	defer func() {
+		if hash.Valid && !committed {
+			tx.Rollback()
+			releaseBlobs(hash.String)
+		}
+	}()
+
+	// table is never user input
+	result, err := tx.Exec(`UPDATE `+table+` SET state = ?, blobHash = ? WHERE uid = ?`, state, hash, uid)
+	if err != nil {
+		return 0, err
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	committed = true
+
+	return ra, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errTrailingData request body has more than single JSON value
+var errTrailingData = errors.New("unexpected data after JSON value")
+
+// decodeJSONBody stream decodes request body into v, reading at most limit bytes.
+// Raw body is returned too, for handlers storing it as is. On error returned status
+// is 413 if body is over limit and 400 otherwise.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) ([]byte, int, error) {
+	var raw bytes.Buffer
+
+	body := http.MaxBytesReader(w, r.Body, limit)
+
+	dec := json.NewDecoder(io.TeeReader(body, &raw))
+	if Config.JSONDisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+	if err != nil {
+		return nil, bodyErrorStatus(err), err
+	}
+
+	// reads rest of the body, so raw has all of it
+	err = dec.Decode(&struct{}{})
+	if err != io.EOF {
+		if err == nil {
+			err = errTrailingData
+		}
+		return nil, bodyErrorStatus(err), err
+	}
+
+	return raw.Bytes(), http.StatusOK, nil
+}
+
+// bodyErrorStatus returns response status for error from reading request body
+func bodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
@@ -0,0 +1,112 @@
+// Command reflector runs Whistler reflector as standalone HTTP server, so it can be
+// deployed on any VPS or edge host and tested locally.
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/BuildAMovement/whistler-backend/reflector"
+	"github.com/codingconcepts/env"
+)
+
+const (
+	dialTimeout         = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+	idleConnTimeout     = 90 * time.Second
+	healthCheckInterval = 15 * time.Second
+	// server side timeouts, write timeout is long so big uploads and downloads pass
+	readHeaderTimeout = 10 * time.Second
+	writeTimeout      = 10 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// ReflectorConfig struct defines config params
+type ReflectorConfig struct {
+	ListenAddr  string `env:"REFLECTOR_LISTEN_ADDR" default:":8080"`
+	TLSCertFile string `env:"REFLECTOR_TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"REFLECTOR_TLS_KEY_FILE"`
+}
+
+// newTransport creates transport shared by all requests. http.Transport does not
+// follow redirects, so client sees them as they are.
+func newTransport(responseHeaderTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		MaxIdleConns:          100,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func main() {
+	config := ReflectorConfig{}
+	err := env.Set(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hosts, err := reflector.LoadHosts()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options, err := reflector.LoadOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transport := newTransport(options.UpstreamTimeout)
+	hosts.StartHealthChecks(transport, healthCheckInterval)
+
+	rf := reflector.New(
+		hosts,
+		func(r *http.Request) http.RoundTripper {
+			return transport
+		},
+		func(r *http.Request, format string, v ...interface{}) {
+			log.Printf("["+r.RemoteAddr+"] "+format, v...)
+		},
+	)
+
+	rf.Options = *options
+
+	rf.Auth, err = reflector.LoadAuth()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rf.Auth == nil {
+		log.Println("REFLECTOR_KEYS not set, reflector is open to any client")
+	}
+
+	rf.Routes, err = reflector.LoadRouteKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rf.Options.DisableHostHeader && rf.Routes == nil {
+		log.Println("Whistler-Host disabled and REFLECTOR_ROUTE_KEYS not set, only fronted requests are served")
+	}
+
+	server := &http.Server{
+		Addr:              config.ListenAddr,
+		Handler:           rf,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	log.Printf("Reflector listening on %s\n", config.ListenAddr)
+
+	if len(config.TLSCertFile) > 0 {
+		log.Fatal(server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile))
+	}
+	log.Fatal(server.ListenAndServe())
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimHeaders are signed when present in message, From is required by RFC 6376
+var dkimHeaders = []string{
+	"from", "to", "reply-to", "subject", "date", "message-id",
+	"mime-version", "content-type", "content-transfer-encoding",
+}
+
+// dkimSigner signs messages with rsa-sha256 using relaxed header and simple body
+// canonicalization
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      *rsa.PrivateKey
+}
+
+// newDKIMSigner loads PKCS#1 or PKCS#8 RSA key from PEM file
+func newDKIMSigner(domain, selector, keyFile string) (*dkimSigner, error) {
+	if len(selector) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("DKIM signing needs FM_DKIM_SELECTOR and FM_DKIM_KEY_FILE")
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found in %s", keyFile)
+	}
+
+	var key *rsa.PrivateKey
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("DKIM key is not RSA key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %s", block.Type)
+	}
+
+	return &dkimSigner{domain: domain, selector: selector, key: key}, nil
+}
+
+// sign returns message with DKIM-Signature header prepended
+func (s *dkimSigner) sign(msg []byte) ([]byte, error) {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, errors.New("message has no body")
+	}
+
+	headers := parseHeaders(msg[:i+2])
+	body := canonicalBodySimple(msg[i+4:])
+
+	bodyHash := sha256.Sum256(body)
+
+	signed := make([]string, 0, len(dkimHeaders))
+	h := sha256.New()
+
+	for _, name := range dkimHeaders {
+		value, ok := headers[name]
+		if !ok {
+			continue
+		}
+		signed = append(signed, name)
+		h.Write([]byte(canonicalHeaderRelaxed(name, value) + "\r\n"))
+	}
+
+	if len(signed) == 0 || signed[0] != "from" {
+		return nil, errors.New("message has no From header")
+	}
+
+	value := " v=1; a=rsa-sha256; c=relaxed/simple; d=" + s.domain + "; s=" + s.selector +
+		"; t=" + strconv.FormatInt(time.Now().UTC().Unix(), 10) +
+		"; h=" + strings.Join(signed, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) +
+		"; b="
+
+	// signature header is hashed last, with empty b= and without trailing CRLF
+	h.Write([]byte(canonicalHeaderRelaxed("dkim-signature", value)))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString("DKIM-Signature:" + value + base64.StdEncoding.EncodeToString(sig) + "\r\n")
+	out.Write(msg)
+
+	return out.Bytes(), nil
+}
+
+// parseHeaders returns raw values of header block by lowercase name, later
+// occurrences win
+func parseHeaders(block []byte) map[string]string {
+	headers := make(map[string]string)
+	lines := strings.Split(string(block), "\r\n")
+
+	name := ""
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		// folded continuation line
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(name) > 0 {
+				headers[name] += "\r\n" + line
+			}
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			name = ""
+			continue
+		}
+
+		name = strings.ToLower(strings.TrimSpace(line[:i]))
+		headers[name] = line[i+1:]
+	}
+
+	return headers
+}
+
+// canonicalHeaderRelaxed implements relaxed header canonicalization from RFC 6376 3.4.2
+func canonicalHeaderRelaxed(name, value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+
+	return strings.ToLower(name) + ":" + value
+}
+
+// canonicalBodySimple implements simple body canonicalization from RFC 6376 3.4.3
+func canonicalBodySimple(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(append([]byte{}, body...), '\r', '\n')
+	}
+
+	return body
+}
@@ -2,24 +2,43 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/julienschmidt/httprouter"
-	mail "gopkg.in/mail.v2"
+)
+
+// Feedback categories
+const (
+	FeedbackCategoryBug      = "bug"
+	FeedbackCategoryAbuse    = "abuse"
+	FeedbackCategorySecurity = "security"
+	FeedbackCategoryOther    = "other"
 )
 
 // Feedback struct for sending feedback
 type Feedback struct {
-	Name    string `json:"name"`
-	Email   string `json:"email" valid:"email"`
-	Message string `json:"message" valid:"required"`
+	UID         string                `json:"-"` // set when feedback is queued
+	Ticket      string                `json:"-"` // set when feedback is queued
+	Category    string                `json:"category" valid:"whistlercategory"`
+	Name        string                `json:"name"`
+	Email       string                `json:"email" valid:"email"`
+	Message     string                `json:"message" valid:"required"`
+	Device      *FeedbackDevice       `json:"device,omitempty"`
+	Attachments []*FeedbackAttachment `json:"attachments,omitempty"`
+}
+
+// FeedbackDevice describes app and device feedback was sent from
+type FeedbackDevice struct {
+	AppVersion string `json:"appVersion,omitempty" valid:"printableascii,length(0|32)"`
+	Platform   string `json:"platform,omitempty" valid:"printableascii,length(0|32)"`
+	OSVersion  string `json:"osVersion,omitempty" valid:"printableascii,length(0|32)"`
+	Model      string `json:"model,omitempty" valid:"printableascii,length(0|64)"`
+	Locale     string `json:"locale,omitempty" valid:"printableascii,length(0|16)"`
 }
 
 // Validate validates feedback data
@@ -39,10 +58,19 @@ func (f *Feedback) Validate() error {
 // creates feedback email body string
 func createMsg(f *Feedback) (string, error) {
 	var msgTemplate = `
+Ticket: {{.Ticket}}
+Category: {{.Category}}
 Name: {{.Name}}
 Email: {{.Email}}
 Message: {{.Message}}
-`
+{{with .Device}}
+App version: {{.AppVersion}}
+Platform: {{.Platform}} {{.OSVersion}}
+Model: {{.Model}}
+Locale: {{.Locale}}
+{{end}}{{range .Attachments}}
+Attachment: {{.Name}} ({{.Size}} bytes)
+{{end}}`
 
 	t, err := template.New("Message").Parse(msgTemplate)
 	if err != nil {
@@ -59,54 +87,94 @@ Message: {{.Message}}
 }
 
 func handleFeedback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if failed(err, w, http.StatusInternalServerError) {
+	if !limitFeedback(w, r) || !checkChallenge(w, r) {
 		return
 	}
 
 	// decode feedback
 	feedback := &Feedback{}
-	err = json.Unmarshal(body, feedback)
-	if failed(err, w, http.StatusBadRequest) {
+	_, status, err := decodeJSONBody(w, r, Config.MaxFeedbackBodyBytes, feedback)
+	if err != nil {
+		writeBodyError(w, status, err)
 		return
 	}
 
 	// validate Feedback obj
 	err = feedback.Validate()
-	if failed(err, w, http.StatusBadRequest) {
+	if err != nil {
+		log.Println(err.Error())
+		writeError(w, http.StatusBadRequest, ErrCodeValidation, validationFields(feedback))
+		return
+	}
+	if len(feedback.Category) == 0 {
+		feedback.Category = FeedbackCategoryOther
+	}
+
+	fields := spamFields(feedback)
+	if fields != nil {
+		logNetPrintf(r, "Feedback rejected as spam: %v\n", fields)
+		writeError(w, http.StatusBadRequest, ErrCodeValidation, fields)
+		return
+	}
+
+	contentHash := feedbackContentHash(feedback)
+
+	duplicate, err := isDuplicateFeedback(contentHash)
+	if failed(err, w, http.StatusInternalServerError, ErrCodeInternal) {
+		return
+	}
+	if duplicate {
+		writeError(w, http.StatusConflict, ErrCodeConflict, nil)
+		return
+	}
+
+	fields, err = decodeAttachments(feedback)
+	defer removeAttachmentFiles(feedback)
+	if failed(err, w, http.StatusInternalServerError, ErrCodeInternal) {
+		return
+	}
+	if fields != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeValidation, fields)
 		return
 	}
 
-	// create msg body
-	msg, err := createMsg(feedback)
-	if failed(err, w, http.StatusBadRequest) {
+	// store first, mail is sent in background so SMTP outage does not lose feedback
+	feedbackStatus, err := queueFeedback(feedback, contentHash)
+	if failed(err, w, http.StatusInternalServerError, ErrCodeInternal) {
 		return
 	}
 
-	// send email
-	message := mail.NewMessage()
-	message.SetHeader("From", Config.FeedbackMailTo)
-	message.SetHeader("To", Config.FeedbackMailTo)
-	message.SetHeader("Subject", Config.FeedbackMailSubject)
-	message.SetBody("text/plain", msg)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedbackStatus)
+}
 
-	d := mail.NewDialer(Config.FeedbackMailSMTPHost, Config.FeedbackMailSMTPPort, "", "")
-	d.LocalName = Config.FeedbackMailLocalHost
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+func handleFeedbackStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	uid := ps.ByName("uid")
 
-	err = d.DialAndSend(message)
-	if failed(err, w, http.StatusInternalServerError) {
+	// validate parameters
+	if !govalidator.IsUUID(uid) {
+		writeError(w, http.StatusBadRequest, ErrCodeBadRequest, nil)
+		return
+	}
+
+	feedbackStatus, err := getFeedbackStatus(uid)
+	if err != nil {
+		if err == NotFound {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedbackStatus)
 }
 
-func failed(err error, w http.ResponseWriter, status int) bool {
+func failed(err error, w http.ResponseWriter, status int, code string) bool {
 	if err != nil {
 		log.Println(err.Error())
-		w.WriteHeader(status)
+		writeError(w, status, code, nil)
 		return true
 	}
 
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// deviceHeader is header android client identifies itself with
+	deviceHeader = "Whistler-Device"
+	// challengeHeader carries challenge client solved
+	challengeHeader = "Whistler-Challenge"
+	// solutionHeader carries nonce solving challenge
+	solutionHeader = "Whistler-Solution"
+	// challengeTTL is how long challenge can be solved and used
+	challengeTTL = 10 * time.Minute
+	// limiterCleanupInterval is how often idle rate limit buckets are dropped
+	limiterCleanupInterval = 10 * time.Minute
+)
+
+var (
+	errChallengeInvalid = errors.New("challenge invalid")
+	errChallengeUsed    = errors.New("challenge already used")
+)
+
+// rateLimiter is in-memory token bucket per key, refilled at rate tokens per hour
+// up to rate. Zero rate disables limiting.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perHour int) *rateLimiter {
+	l := &rateLimiter{
+		rate:    float64(perHour),
+		buckets: make(map[string]*rateBucket),
+	}
+
+	if perHour > 0 {
+		go func() {
+			for range time.Tick(limiterCleanupInterval) {
+				l.cleanup()
+			}
+		}()
+	}
+
+	return l
+}
+
+// allow takes token for key, when there is none it returns time after which
+// next one is available
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.rate, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Hours() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Hour))
+	}
+
+	b.tokens--
+
+	return true, 0
+}
+
+// cleanup drops buckets which are full again
+func (l *rateLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Hours()*l.rate >= l.rate {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	feedbackIPLimiter     *rateLimiter
+	feedbackDeviceLimiter *rateLimiter
+	// trustedProxies may add X-Forwarded-For hops
+	trustedProxies []*net.IPNet
+	// challengeSecret signs challenges, challenges do not survive restart
+	challengeSecret = make([]byte, 32)
+	// usedChallenges maps spent challenge to its expiry
+	usedChallenges   = make(map[string]int64)
+	usedChallengesMu sync.Mutex
+)
+
+// configureFeedbackAbuse prepares rate limiters, trusted proxies and challenge secret
+func configureFeedbackAbuse() error {
+	feedbackIPLimiter = newRateLimiter(Config.FeedbackIPRate)
+	feedbackDeviceLimiter = newRateLimiter(Config.FeedbackDeviceRate)
+
+	for _, proxy := range Config.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %s", err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	_, err := rand.Read(challengeSecret)
+
+	return err
+}
+
+// trustedProxy checks addr belongs to one of TRUSTED_PROXIES
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns address client connected from. Behind trusted proxies it is
+// last X-Forwarded-For hop not added by trusted proxy, hops before it are sent
+// by client and can be anything.
+func clientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	if !trustedProxy(addr) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if len(hop) == 0 {
+			continue
+		}
+
+		addr = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// rateKey returns key client is rate limited by, key reflector signed for client
+// or client address
+func rateKey(r *http.Request) string {
+	if client := forwardedClient(r); len(client) > 0 {
+		return "reflector:" + client
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+// limitFeedback checks feedback rate limits, on failure it writes response and returns false
+func limitFeedback(w http.ResponseWriter, r *http.Request) bool {
+	key := rateKey(r)
+
+	ok, retry := feedbackIPLimiter.allow(key)
+	if ok {
+		// clients without device header share bucket with their address, so
+		// leaving header out does not skip device limit
+		device := key
+		if d := r.Header.Get(deviceHeader); len(d) > 0 && len(d) <= 64 {
+			device = "device:" + d
+		}
+		ok, retry = feedbackDeviceLimiter.allow(device)
+	}
+
+	if !ok {
+		logNetPrintf(r, "Feedback rate limited\n")
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+		writeError(w, http.StatusTooManyRequests, ErrCodeRateLimited, nil)
+		return false
+	}
+
+	return true
+}
+
+// FeedbackChallenge is proof of work client must solve before sending feedback.
+// Solution is nonce for which SHA-256 of challenge, ":" and nonce starts with
+// Difficulty zero bits.
+type FeedbackChallenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+	Expires    int64  `json:"expires"`
+}
+
+// newChallenge creates stateless challenge, random and expiry signed with challengeSecret
+func newChallenge() (*FeedbackChallenge, error) {
+	expires := time.Now().Add(challengeTTL).Unix()
+
+	payload := make([]byte, 24)
+	_, err := rand.Read(payload[:16])
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(payload[16:], uint64(expires))
+
+	mac := hmac.New(sha256.New, challengeSecret)
+	mac.Write(payload)
+
+	return &FeedbackChallenge{
+		Challenge: base64.RawURLEncoding.EncodeToString(payload) + "." +
+			base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+		Difficulty: Config.FeedbackPoWDifficulty,
+		Expires:    expires,
+	}, nil
+}
+
+// verifyChallenge checks signature, expiry and solution of challenge and marks it used
+func verifyChallenge(challenge, solution string) error {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 2 || len(solution) == 0 || len(solution) > 64 {
+		return errChallengeInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) != 24 {
+		return errChallengeInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errChallengeInvalid
+	}
+
+	mac := hmac.New(sha256.New, challengeSecret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errChallengeInvalid
+	}
+
+	now := time.Now().Unix()
+	expires := int64(binary.BigEndian.Uint64(payload[16:]))
+	if expires < now {
+		return errChallengeInvalid
+	}
+
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+solution))) < Config.FeedbackPoWDifficulty {
+		return errChallengeInvalid
+	}
+
+	usedChallengesMu.Lock()
+	defer usedChallengesMu.Unlock()
+
+	for c, e := range usedChallenges {
+		if e < now {
+			delete(usedChallenges, c)
+		}
+	}
+
+	if _, ok := usedChallenges[challenge]; ok {
+		return errChallengeUsed
+	}
+	usedChallenges[challenge] = expires
+
+	return nil
+}
+
+// leadingZeroBits counts zero bits at start of hash
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+
+	return n
+}
+
+// checkChallenge verifies proof of work when it is enabled, on failure it writes
+// response and returns false
+func checkChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if Config.FeedbackPoWDifficulty <= 0 {
+		return true
+	}
+
+	err := verifyChallenge(r.Header.Get(challengeHeader), r.Header.Get(solutionHeader))
+	if err != nil {
+		logNetPrintf(r, "Feedback %s\n", err)
+		writeError(w, http.StatusForbidden, ErrCodeChallengeFailed, nil)
+		return false
+	}
+
+	return true
+}
+
+func handleFeedbackChallenge(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challenge, err := newChallenge()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(challenge)
+}
+
+// spamFields returns reasons why feedback looks like spam, nil if it looks fine
+func spamFields(f *Feedback) map[string]string {
+	fields := make(map[string]string)
+
+	if len(f.Name) > 100 {
+		fields["name"] = "too long"
+	} else if countLinks(f.Name) > 0 {
+		fields["name"] = "can not contain links"
+	}
+
+	if len(f.Message) > Config.FeedbackMaxMessageLength {
+		fields["message"] = "too long"
+	} else if countLinks(f.Message) > Config.FeedbackMaxLinks {
+		fields["message"] = "too many links"
+	} else if strings.Contains(strings.ToLower(f.Message), "[url=") {
+		fields["message"] = "can not contain markup links"
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return fields
+}
+
+// countLinks counts things that look like links in text
+func countLinks(text string) int {
+	text = strings.ToLower(text)
+
+	return strings.Count(text, "http://") + strings.Count(text, "https://") +
+		strings.Count(text, "www.")
+}
+
+// feedbackContentHash identifies message regardless of case and whitespace,
+// it is used to suppress duplicates
+func feedbackContentHash(f *Feedback) string {
+	content := strings.Join(strings.Fields(strings.ToLower(f.Email+" "+f.Message)), " ")
+	sum := sha256.Sum256([]byte(content))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// isDuplicateFeedback checks if same content was queued within duplicate window
+func isDuplicateFeedback(hash string) (bool, error) {
+	if Config.FeedbackDuplicateWindow <= 0 {
+		return false, nil
+	}
+
+	since := time.Now().UTC().Unix() - Config.FeedbackDuplicateWindow
+
+	var count int64
+	err := DB.QueryRow(`SELECT COUNT(*) FROM feedback WHERE contentHash = ? AND created >= ?`,
+		hash, since).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultFeedbackPage and maxFeedbackPage bound admin feedback list
+	defaultFeedbackPage = 50
+	maxFeedbackPage     = 200
+)
+
+// AdminFeedback is feedback as seen by admins
+type AdminFeedback struct {
+	ID          int64                 `json:"id"`
+	UID         string                `json:"uid"`
+	Ticket      string                `json:"ticket"`
+	Category    string                `json:"category"`
+	Name        string                `json:"name"`
+	Email       string                `json:"email"`
+	Message     string                `json:"message"`
+	Device      *FeedbackDevice       `json:"device,omitempty"`
+	Attachments []*FeedbackAttachment `json:"attachments"`
+	Handled     bool                  `json:"handled"`
+	HandledAt   int64                 `json:"handledAt,omitempty"`
+	Created     int64                 `json:"created"`
+}
+
+// handleAdminListFeedback lists newest feedback first. It can be filtered by
+// category, handled (0 or 1) and ticket, and paged with cursor (last id seen) and limit.
+func handleAdminListFeedback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := r.URL.Query()
+	fields := make(map[string]string)
+
+	where := "1 = 1"
+	args := make([]interface{}, 0)
+
+	if category := query.Get("category"); len(category) > 0 {
+		where += " AND category = ?"
+		args = append(args, category)
+	}
+
+	if ticket := query.Get("ticket"); len(ticket) > 0 {
+		where += " AND ticket = ?"
+		args = append(args, ticket)
+	}
+
+	switch query.Get("handled") {
+	case "":
+	case "0":
+		where += " AND handled = 0"
+	case "1":
+		where += " AND handled = 1"
+	default:
+		fields["handled"] = "must be 0 or 1"
+	}
+
+	if cursor := query.Get("cursor"); len(cursor) > 0 {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || id <= 0 {
+			fields["cursor"] = "invalid cursor"
+		}
+		where += " AND id < ?"
+		args = append(args, id)
+	}
+
+	limit := defaultFeedbackPage
+	if l := query.Get("limit"); len(l) > 0 {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxFeedbackPage {
+			fields["limit"] = "limit must be between 1 and " + strconv.Itoa(maxFeedbackPage)
+		}
+	}
+
+	if len(fields) > 0 {
+		writeError(w, 400, ErrCodeValidation, fields)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT
+			id, uid, ticket, category, name, email, message, device, handled, handledAt, created
+		FROM
+			feedback
+		WHERE
+			`+where+`
+		ORDER BY id DESC
+		LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	feedback := make([]*AdminFeedback, 0)
+
+	for rows.Next() {
+		f := &AdminFeedback{}
+		var device sql.NullString
+		var handledAt sql.NullInt64
+
+		err = rows.Scan(&f.ID, &f.UID, &f.Ticket, &f.Category, &f.Name, &f.Email, &f.Message,
+			&device, &f.Handled, &handledAt, &f.Created)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		f.HandledAt = handledAt.Int64
+
+		if device.Valid {
+			f.Device = &FeedbackDevice{}
+			err = json.Unmarshal([]byte(device.String), f.Device)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+		}
+
+		feedback = append(feedback, f)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	rows.Close()
+
+	for _, f := range feedback {
+		f.Attachments, err = feedbackAttachments(f.ID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedback)
+}
+
+// setFeedbackHandled returns handler marking feedback handled or reopening it
+func setFeedbackHandled(handled bool) httprouter.Handle {
+	action := "reopen"
+	if handled {
+		action = "handle"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, ok := paramID(ps)
+		if !ok {
+			writeError(w, 400, ErrCodeBadRequest, nil)
+			return
+		}
+
+		tx, err := DB.Begin()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		defer tx.Rollback()
+
+		var handledAt sql.NullInt64
+		if handled {
+			handledAt = sql.NullInt64{Int64: time.Now().UTC().Unix(), Valid: true}
+		}
+
+		var count int64
+		err = tx.QueryRow(`SELECT COUNT(*) FROM feedback WHERE id = ? FOR UPDATE`, id).Scan(&count)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if count == 0 {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE feedback SET handled = ?, handledAt = ? WHERE id = ?`, handled, handledAt, id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		err = audit(tx, r, action, "feedback", id, nil)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		log.Printf("Feedback %d handled: %t\n", id, handled)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
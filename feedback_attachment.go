@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// screenshotTypes maps allowed screenshot extensions to content type sniffed from data
+var screenshotTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// FeedbackAttachment is screenshot sent with feedback. Data is base64 encoded
+// file, it is only used on input.
+type FeedbackAttachment struct {
+	Name        string `json:"name" valid:"required,whistlerscreenshot"`
+	Data        string `json:"data,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	tmpPath     string
+}
+
+// decodeAttachments checks screenshots and stores them into temp files, so JSON
+// body is not kept in memory while feedback is queued. It returns per-field errors
+// for client mistakes.
+func decodeAttachments(f *Feedback) (map[string]string, error) {
+	if len(f.Attachments) > Config.FeedbackMaxAttachments {
+		return map[string]string{"attachments": fmt.Sprintf("at most %d allowed", Config.FeedbackMaxAttachments)}, nil
+	}
+
+	names := make(map[string]bool)
+	for i, a := range f.Attachments {
+		if names[a.Name] {
+			return map[string]string{fmt.Sprintf("attachments.%d.name", i): "duplicate name"}, nil
+		}
+		names[a.Name] = true
+	}
+
+	dir := path.Join(Config.BaseDir, tmpDir)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, a := range f.Attachments {
+		field := fmt.Sprintf("attachments.%d.data", i)
+
+		data, err := base64.StdEncoding.DecodeString(a.Data)
+		if err != nil {
+			return map[string]string{field: "not valid base64"}, nil
+		}
+
+		if int64(len(data)) > Config.FeedbackMaxAttachmentBytes {
+			return map[string]string{field: fmt.Sprintf("larger than %d bytes", Config.FeedbackMaxAttachmentBytes)}, nil
+		}
+
+		ext := strings.ToLower(path.Ext(a.Name))
+		contentType := http.DetectContentType(data)
+		if len(ext) < 2 || screenshotTypes[ext[1:]] != contentType {
+			return map[string]string{field: "content does not match " + ext + " image"}, nil
+		}
+
+		out, err := ioutil.TempFile(dir, "attachment-")
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = out.Write(data)
+		if err == nil {
+			err = out.Close()
+		} else {
+			out.Close()
+		}
+		if err != nil {
+			os.Remove(out.Name())
+			return nil, err
+		}
+
+		a.Data = ""
+		a.ContentType = contentType
+		a.Size = int64(len(data))
+		a.tmpPath = out.Name()
+	}
+
+	return nil, nil
+}
+
+// removeAttachmentFiles deletes temp files of attachments not moved to blob storage
+func removeAttachmentFiles(f *Feedback) {
+	for _, a := range f.Attachments {
+		if len(a.tmpPath) > 0 {
+			os.Remove(a.tmpPath)
+		}
+	}
+}
+
+// insertAttachments moves attachment temp files into blob storage and records them
+func insertAttachments(tx *sql.Tx, feedbackID int64, f *Feedback) error {
+	for _, a := range f.Attachments {
+		hash, size, err := importBlob(tx, a.tmpPath)
+		if err != nil {
+			return err
+		}
+		a.tmpPath = ""
+		a.SHA256 = hash
+
+		_, err = tx.Exec(`
+			INSERT INTO feedback_attachment (
+				feedbackId, name, contentType, size, blobHash
+			) VALUES (
+				?, ?, ?, ?, ?
+			)`, feedbackID, a.Name, a.ContentType, size, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// feedbackAttachments returns attachments of feedback with id
+func feedbackAttachments(feedbackID int64) ([]*FeedbackAttachment, error) {
+	rows, err := DB.Query(`
+		SELECT
+			name, contentType, size, blobHash
+		FROM
+			feedback_attachment
+		WHERE
+			feedbackId = ?
+		ORDER BY id`, feedbackID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]*FeedbackAttachment, 0)
+
+	for rows.Next() {
+		a := &FeedbackAttachment{}
+
+		err = rows.Scan(&a.Name, &a.ContentType, &a.Size, &a.SHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, a)
+	}
+
+	return attachments, rows.Err()
+}
+
+func handleAdminFeedbackAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	var contentType, hash string
+
+	row := DB.QueryRow(`
+		SELECT
+			contentType, blobHash
+		FROM
+			feedback_attachment
+		WHERE
+			feedbackId = ? AND name = ?`, id, ps.ByName("name"))
+	err := row.Scan(&contentType, &hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, blobPath(hash))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+
+	mail "gopkg.in/mail.v2"
+)
+
+// SMTP TLS modes used in FM_SMTP_TLS
+const (
+	MailTLSStartTLS = "starttls"
+	MailTLSImplicit = "tls"
+	MailTLSNone     = "none"
+)
+
+// SMTP auth mechanisms used in FM_SMTP_AUTH
+const (
+	MailAuthNone    = "none"
+	MailAuthPlain   = "plain"
+	MailAuthXOAuth2 = "xoauth2"
+)
+
+var (
+	// mailDialer is SMTP dialer built from config at startup
+	mailDialer *mail.Dialer
+	// mailSigner signs outgoing feedback mail, nil when DKIM is not configured
+	mailSigner *dkimSigner
+)
+
+// configureFeedbackMail prepares SMTP dialer and DKIM signer from config
+func configureFeedbackMail() error {
+	d := mail.NewDialer(Config.FeedbackMailSMTPHost, Config.FeedbackMailSMTPPort, "", "")
+	d.LocalName = Config.FeedbackMailLocalHost
+
+	tlsConfig := &tls.Config{
+		ServerName: Config.FeedbackMailSMTPHost,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(Config.FeedbackMailCAFile) > 0 {
+		pem, err := ioutil.ReadFile(Config.FeedbackMailCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", Config.FeedbackMailCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	d.TLSConfig = tlsConfig
+
+	switch Config.FeedbackMailTLS {
+	case MailTLSStartTLS:
+		d.StartTLSPolicy = mail.MandatoryStartTLS
+	case MailTLSImplicit:
+		d.SSL = true
+	case MailTLSNone:
+		d.StartTLSPolicy = mail.NoStartTLS
+	default:
+		return fmt.Errorf("unknown FM_SMTP_TLS mode %q", Config.FeedbackMailTLS)
+	}
+
+	switch Config.FeedbackMailAuth {
+	case MailAuthNone:
+	case MailAuthPlain:
+		if len(Config.FeedbackMailUser) == 0 || len(Config.FeedbackMailPassword) == 0 {
+			return errors.New("plain SMTP auth needs FM_SMTP_USER and FM_SMTP_PASSWORD")
+		}
+		// dialer picks PLAIN or LOGIN depending on what server offers
+		d.Username = Config.FeedbackMailUser
+		d.Password = Config.FeedbackMailPassword
+	case MailAuthXOAuth2:
+		if len(Config.FeedbackMailUser) == 0 || len(Config.FeedbackMailTokenFile) == 0 {
+			return errors.New("xoauth2 SMTP auth needs FM_SMTP_USER and FM_SMTP_TOKEN_FILE")
+		}
+		d.Auth = &xoauth2Auth{
+			username:  Config.FeedbackMailUser,
+			tokenFile: Config.FeedbackMailTokenFile,
+			host:      Config.FeedbackMailSMTPHost,
+		}
+	default:
+		return fmt.Errorf("unknown FM_SMTP_AUTH mechanism %q", Config.FeedbackMailAuth)
+	}
+
+	if Config.FeedbackMailAuth != MailAuthNone && Config.FeedbackMailTLS == MailTLSNone {
+		return errors.New("SMTP auth needs FM_SMTP_TLS starttls or tls")
+	}
+
+	_, err := netmail.ParseAddress(feedbackMailFrom())
+	if err != nil {
+		return fmt.Errorf("FM_FROM or FM_TO is not valid address: %s", err)
+	}
+
+	if len(Config.FeedbackMailDKIMDomain) > 0 {
+		signer, err := newDKIMSigner(Config.FeedbackMailDKIMDomain, Config.FeedbackMailDKIMSelector,
+			Config.FeedbackMailDKIMKeyFile)
+		if err != nil {
+			return err
+		}
+		mailSigner = signer
+	}
+
+	mailDialer = d
+
+	return nil
+}
+
+// feedbackMailFrom returns sender address, FM_TO when FM_FROM is not set
+func feedbackMailFrom() string {
+	if len(Config.FeedbackMailFrom) > 0 {
+		return Config.FeedbackMailFrom
+	}
+
+	return Config.FeedbackMailTo
+}
+
+// feedbackSubject returns subject with category and ticket, so inbox can be filtered
+func feedbackSubject(f *Feedback) string {
+	return Config.FeedbackMailSubject + " [" + f.Category + "] " + f.Ticket
+}
+
+// sendFeedbackMail sends feedback email to configured address
+func sendFeedbackMail(f *Feedback) error {
+	// create msg body
+	msg, err := createMsg(f)
+	if err != nil {
+		return err
+	}
+
+	from := feedbackMailFrom()
+
+	message := mail.NewMessage()
+	message.SetHeader("From", from)
+	message.SetHeader("To", Config.FeedbackMailTo)
+	message.SetHeader("Subject", feedbackSubject(f))
+	if len(f.Email) > 0 {
+		message.SetHeader("Reply-To", f.Email)
+	}
+	message.SetBody("text/plain", msg)
+	for _, a := range f.Attachments {
+		message.Attach(blobPath(a.SHA256), mail.Rename(a.Name))
+	}
+
+	if mailSigner == nil {
+		return mailDialer.DialAndSend(message)
+	}
+
+	var raw bytes.Buffer
+	_, err = message.WriteTo(&raw)
+	if err != nil {
+		return err
+	}
+
+	signed, err := mailSigner.sign(raw.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// FM_FROM can have display name, envelope needs bare address
+	sender, err := netmail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+
+	s, err := mailDialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Send(sender.Address, []string{Config.FeedbackMailTo}, bytes.NewBuffer(signed))
+}
+
+// xoauth2Auth implements XOAUTH2 SASL mechanism. Access token is read from file
+// on every connection so external refresher can rotate it.
+type xoauth2Auth struct {
+	username  string
+	tokenFile string
+	host      string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("xoauth2 needs encrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	token, err := ioutil.ReadFile(a.tokenFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp := "user=" + a.username + "\x01auth=Bearer " + strings.TrimSpace(string(token)) + "\x01\x01"
+
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// server sent error details, empty response makes it finish with failure
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Feedback delivery states
+const (
+	FeedbackPending = "pending"
+	FeedbackSent    = "sent"
+	FeedbackFailed  = "failed"
+)
+
+const (
+	// feedbackPollInterval is how often outbox is checked for due feedback
+	feedbackPollInterval = 30 * time.Second
+	// feedbackBatch is most feedback sent in one outbox pass
+	feedbackBatch = 20
+	// feedbackLease is how long claimed feedback is hidden from other senders
+	feedbackLease = 5 * time.Minute
+	// feedbackMinBackoff and feedbackMaxBackoff bound retry delay
+	feedbackMinBackoff = 30 * time.Second
+	feedbackMaxBackoff = 6 * time.Hour
+	// feedbackTicketLength is number of random characters in ticket id
+	feedbackTicketLength = 8
+)
+
+// FeedbackStatus returned to client so it can check feedback was delivered and handled
+type FeedbackStatus struct {
+	UID       string `json:"uid"`
+	Ticket    string `json:"ticket"`
+	Category  string `json:"category"`
+	Status    string `json:"status"`
+	Handled   bool   `json:"handled"`
+	HandledAt int64  `json:"handledAt,omitempty"`
+	Created   int64  `json:"created"`
+}
+
+// newFeedbackTicket generates ticket id user can quote when contacting support
+func newFeedbackTicket() (string, error) {
+	code, err := randomCode(feedbackTicketLength)
+	if err != nil {
+		return "", err
+	}
+
+	return "WH-" + code[:4] + "-" + code[4:], nil
+}
+
+// feedbackWake wakes sender when new feedback is queued
+var feedbackWake = make(chan struct{}, 1)
+
+// queueFeedback stores feedback in outbox with delivery for every configured sink
+func queueFeedback(f *Feedback, contentHash string) (*FeedbackStatus, error) {
+	ticket, err := newFeedbackTicket()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &FeedbackStatus{
+		UID:      uuid.New().String(),
+		Ticket:   ticket,
+		Category: f.Category,
+		Status:   FeedbackPending,
+		Created:  time.Now().UTC().Unix(),
+	}
+
+	var device sql.NullString
+	if f.Device != nil {
+		data, err := json.Marshal(f.Device)
+		if err != nil {
+			return nil, err
+		}
+		device = sql.NullString{String: string(data), Valid: true}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO feedback (
+			uid, ticket, category, name, email, message, device, contentHash, handled, created
+		) VALUES (
+			?, ?, ?, ?, ?, ?, ?, ?, 0, ?
+		)`, status.UID, status.Ticket, status.Category, f.Name, f.Email, f.Message, device,
+		contentHash, status.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	feedbackID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	// attachment blobs linked by rolled back transaction are released
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+			for _, a := range f.Attachments {
+				if len(a.SHA256) > 0 {
+					releaseBlobs(a.SHA256)
+				}
+			}
+		}
+	}()
+
+	err = insertAttachments(tx, feedbackID, f)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range feedbackSinks {
+		_, err = tx.Exec(`
+			INSERT INTO feedback_delivery (
+				feedbackId, sink, status, attempts, nextAttempt
+			) VALUES (
+				?, ?, ?, 0, ?
+			)`, feedbackID, name, FeedbackPending, status.Created)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	committed = true
+
+	select {
+	case feedbackWake <- struct{}{}:
+	default:
+	}
+
+	return status, nil
+}
+
+// getFeedbackStatus gets delivery status of feedback with uid. Feedback is sent when
+// all sinks got it, failed when some sink gave up and pending otherwise.
+func getFeedbackStatus(uid string) (*FeedbackStatus, error) {
+	rows, err := DB.Query(`
+		SELECT
+			feedback.uid, feedback.ticket, feedback.category, feedback.handled, feedback.handledAt,
+			feedback.created, feedback_delivery.status
+		FROM
+			feedback JOIN feedback_delivery ON feedback.id = feedback_delivery.feedbackId
+		WHERE
+			feedback.uid = ?`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var status *FeedbackStatus
+	pending, failed := false, false
+
+	for rows.Next() {
+		var deliveryStatus string
+		var handledAt sql.NullInt64
+
+		if status == nil {
+			status = &FeedbackStatus{}
+		}
+
+		err = rows.Scan(&status.UID, &status.Ticket, &status.Category, &status.Handled, &handledAt,
+			&status.Created, &deliveryStatus)
+		if err != nil {
+			return nil, err
+		}
+		status.HandledAt = handledAt.Int64
+
+		switch deliveryStatus {
+		case FeedbackPending:
+			pending = true
+		case FeedbackFailed:
+			failed = true
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if status == nil {
+		return nil, NotFound
+	}
+
+	switch {
+	case pending:
+		status.Status = FeedbackPending
+	case failed:
+		status.Status = FeedbackFailed
+	default:
+		status.Status = FeedbackSent
+	}
+
+	return status, nil
+}
+
+// feedbackBackoff returns delay before next attempt, doubling from feedbackMinBackoff
+// up to feedbackMaxBackoff, with jitter so retries of many messages spread out
+func feedbackBackoff(attempts int) time.Duration {
+	backoff := feedbackMaxBackoff
+	if attempts < 20 {
+		backoff = feedbackMinBackoff << uint(attempts-1)
+		if backoff > feedbackMaxBackoff {
+			backoff = feedbackMaxBackoff
+		}
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// queuedDelivery is feedback waiting in outbox for one sink
+type queuedDelivery struct {
+	feedbackID  int64
+	sink        string
+	attempts    int
+	nextAttempt int64
+	feedback    Feedback
+}
+
+// dueDeliveries returns pending deliveries that should be tried now
+func dueDeliveries(now int64) ([]queuedDelivery, error) {
+	rows, err := DB.Query(`
+		SELECT
+			feedback_delivery.feedbackId, feedback_delivery.sink, feedback_delivery.attempts,
+			feedback_delivery.nextAttempt, feedback.uid, feedback.ticket, feedback.category,
+			feedback.name, feedback.email, feedback.message, feedback.device
+		FROM
+			feedback_delivery JOIN feedback ON feedback_delivery.feedbackId = feedback.id
+		WHERE
+			feedback_delivery.status = ? AND feedback_delivery.nextAttempt <= ?
+		ORDER BY feedback_delivery.nextAttempt
+		LIMIT ?`, FeedbackPending, now, feedbackBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queued := make([]queuedDelivery, 0)
+
+	for rows.Next() {
+		var q queuedDelivery
+		var device sql.NullString
+
+		err = rows.Scan(&q.feedbackID, &q.sink, &q.attempts, &q.nextAttempt,
+			&q.feedback.UID, &q.feedback.Ticket, &q.feedback.Category,
+			&q.feedback.Name, &q.feedback.Email, &q.feedback.Message, &device)
+		if err != nil {
+			return nil, err
+		}
+
+		if device.Valid {
+			q.feedback.Device = &FeedbackDevice{}
+			err = json.Unmarshal([]byte(device.String), q.feedback.Device)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		queued = append(queued, q)
+	}
+
+	return queued, rows.Err()
+}
+
+// claimDelivery hides delivery from other senders for feedbackLease, false is returned
+// if someone else claimed it first
+func claimDelivery(q *queuedDelivery, now int64) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE feedback_delivery SET
+			nextAttempt = ?
+		WHERE
+			feedbackId = ? AND sink = ? AND nextAttempt = ?`,
+		now+int64(feedbackLease/time.Second), q.feedbackID, q.sink, q.nextAttempt)
+	if err != nil {
+		return false, err
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return ra == 1, nil
+}
+
+// deliver tries to send feedback to sink and records outcome
+func deliver(q *queuedDelivery) error {
+	var sendErr error
+
+	attachments, err := feedbackAttachments(q.feedbackID)
+	if err != nil {
+		return err
+	}
+	q.feedback.Attachments = attachments
+
+	sink, ok := feedbackSinks[q.sink]
+	if ok {
+		sendErr = sink.Send(&q.feedback)
+	} else {
+		sendErr = errors.New("sink " + q.sink + " is not configured")
+	}
+
+	now := time.Now().UTC().Unix()
+	attempts := q.attempts + 1
+
+	if sendErr == nil {
+		_, err = DB.Exec(`
+			UPDATE feedback_delivery SET
+				status = ?, attempts = ?, sent = ?, lastError = NULL
+			WHERE
+				feedbackId = ? AND sink = ?`, FeedbackSent, attempts, now, q.feedbackID, q.sink)
+		return err
+	}
+
+	log.Printf("Sending feedback %d to %s failed: %s\n", q.feedbackID, q.sink, sendErr)
+
+	status := FeedbackPending
+	if attempts >= Config.FeedbackMaxAttempts || !ok {
+		status = FeedbackFailed
+	}
+
+	_, err = DB.Exec(`
+		UPDATE feedback_delivery SET
+			status = ?, attempts = ?, nextAttempt = ?, lastError = ?
+		WHERE
+			feedbackId = ? AND sink = ?`,
+		status, attempts, now+int64(feedbackBackoff(attempts)/time.Second), sendErr.Error(), q.feedbackID, q.sink)
+
+	return err
+}
+
+// sendDueFeedback does one outbox pass
+func sendDueFeedback() {
+	now := time.Now().UTC().Unix()
+
+	queued, err := dueDeliveries(now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range queued {
+		q := &queued[i]
+
+		claimed, err := claimDelivery(q, now)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if !claimed {
+			continue
+		}
+
+		err = deliver(q)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// startFeedbackSender runs outbox sender in background
+func startFeedbackSender() {
+	go func() {
+		ticker := time.NewTicker(feedbackPollInterval)
+		defer ticker.Stop()
+
+		for {
+			sendDueFeedback()
+
+			select {
+			case <-ticker.C:
+			case <-feedbackWake:
+			}
+		}
+	}()
+}
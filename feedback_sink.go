@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Feedback sink names used in FEEDBACK_SINKS
+const (
+	SinkSMTP    = "smtp"
+	SinkWebhook = "webhook"
+	SinkChat    = "chat"
+)
+
+// sinkTimeout bounds single webhook delivery
+const sinkTimeout = 15 * time.Second
+
+// FeedbackSink delivers feedback to one destination
+type FeedbackSink interface {
+	Name() string
+	Send(f *Feedback) error
+}
+
+// feedbackSinks configured at startup, feedback is fanned out to all of them
+var feedbackSinks = make(map[string]FeedbackSink)
+
+// configureFeedbackSinks creates sinks listed in Config.FeedbackSinks
+func configureFeedbackSinks() error {
+	client := &http.Client{Timeout: sinkTimeout}
+
+	for _, name := range Config.FeedbackSinks {
+		var sink FeedbackSink
+
+		switch name {
+		case SinkSMTP:
+			if len(Config.FeedbackMailTo) == 0 || len(Config.FeedbackMailSMTPHost) == 0 || Config.FeedbackMailSMTPPort == 0 {
+				return errors.New("smtp feedback sink needs FM_TO, FM_SMTP_HOST and FM_SMTP_PORT")
+			}
+			err := configureFeedbackMail()
+			if err != nil {
+				return err
+			}
+			sink = &smtpSink{}
+		case SinkWebhook:
+			if len(Config.FeedbackWebhookURL) == 0 || len(Config.FeedbackWebhookSecret) == 0 {
+				return errors.New("webhook feedback sink needs FEEDBACK_WEBHOOK_URL and FEEDBACK_WEBHOOK_SECRET")
+			}
+			sink = &webhookSink{url: Config.FeedbackWebhookURL, secret: []byte(Config.FeedbackWebhookSecret), client: client}
+		case SinkChat:
+			if len(Config.FeedbackChatWebhookURL) == 0 {
+				return errors.New("chat feedback sink needs FEEDBACK_CHAT_WEBHOOK_URL")
+			}
+			sink = &chatSink{url: Config.FeedbackChatWebhookURL, client: client}
+		default:
+			return fmt.Errorf("unknown feedback sink %q", name)
+		}
+
+		feedbackSinks[name] = sink
+	}
+
+	if len(feedbackSinks) == 0 {
+		return errors.New("no feedback sinks configured")
+	}
+
+	return nil
+}
+
+// smtpSink mails feedback to FM_TO
+type smtpSink struct{}
+
+func (s *smtpSink) Name() string {
+	return SinkSMTP
+}
+
+func (s *smtpSink) Send(f *Feedback) error {
+	return sendFeedbackMail(f)
+}
+
+// webhookPayload is JSON posted by webhookSink
+type webhookPayload struct {
+	UID         string                `json:"uid"`
+	Ticket      string                `json:"ticket"`
+	Category    string                `json:"category"`
+	Name        string                `json:"name"`
+	Email       string                `json:"email"`
+	Message     string                `json:"message"`
+	Device      *FeedbackDevice       `json:"device,omitempty"`
+	Attachments []*FeedbackAttachment `json:"attachments,omitempty"`
+}
+
+// webhookSink posts feedback as JSON signed with HMAC-SHA256. Receiver should compute
+// HMAC of timestamp header, "." and body with shared secret, compare it to signature
+// header and reject old timestamps.
+type webhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (s *webhookSink) Name() string {
+	return SinkWebhook
+}
+
+func (s *webhookSink) Send(f *Feedback) error {
+	body, err := json.Marshal(&webhookPayload{
+		UID:         f.UID,
+		Ticket:      f.Ticket,
+		Category:    f.Category,
+		Name:        f.Name,
+		Email:       f.Email,
+		Message:     f.Message,
+		Device:      f.Device,
+		Attachments: f.Attachments,
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().UTC().Unix(), 10)
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Whistler-Timestamp", timestamp)
+	req.Header.Set("Whistler-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	return postWebhook(s.client, req)
+}
+
+// chatSink posts feedback as text to Slack or Matrix compatible incoming webhook
+type chatSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *chatSink) Name() string {
+	return SinkChat
+}
+
+func (s *chatSink) Send(f *Feedback) error {
+	msg, err := createMsg(f)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"text": feedbackSubject(f) + "\n" + msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return postWebhook(s.client, req)
+}
+
+// postWebhook sends request and fails on non 2xx response
+func postWebhook(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", req.URL.Host, resp.Status)
+	}
+
+	return nil
+}
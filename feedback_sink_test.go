@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testFeedback() *Feedback {
+	return &Feedback{
+		UID:      "2f0d1c7e-4d3b-4a8e-9b1a-3f6c2d1e0a9b",
+		Ticket:   "WH-AB3D-9KXZ",
+		Category: "bug",
+		Name:     "Jane",
+		Email:    "jane@example.com",
+		Message:  "App crashes on upload",
+	}
+}
+
+func TestWebhookSinkSignsTimestampAndBody(t *testing.T) {
+	secret := []byte("webhook secret")
+
+	var timestamp, signature string
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp = r.Header.Get("Whistler-Timestamp")
+		signature = r.Header.Get("Whistler-Signature")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	sink := &webhookSink{url: server.URL, secret: secret, client: server.Client()}
+
+	err := sink.Send(testFeedback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + string(body)))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if len(timestamp) == 0 || signature != expected {
+		t.Errorf("signature %q of timestamp %q does not match %q", signature, timestamp, expected)
+	}
+
+	var payload webhookPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.UID != testFeedback().UID || payload.Ticket != testFeedback().Ticket {
+		t.Errorf("unexpected payload %s", body)
+	}
+}
+
+func TestWebhookSinkFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	sink := &webhookSink{url: server.URL, secret: []byte("secret"), client: server.Client()}
+
+	if sink.Send(testFeedback()) == nil {
+		t.Error("expected error for 500 response")
+	}
+}
+
+func TestChatSinkPostsText(t *testing.T) {
+	Config.FeedbackMailSubject = "Whistler feedback"
+
+	var payload map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	sink := &chatSink{url: server.URL, client: server.Client()}
+
+	err := sink.Send(testFeedback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := payload["text"]
+	if !strings.HasPrefix(text, "Whistler feedback [bug] WH-AB3D-9KXZ\n") ||
+		!strings.Contains(text, "Message: App crashes on upload") {
+		t.Errorf("unexpected chat text %q", text)
+	}
+}
+
+// smtpMessage is envelope and data received by fake SMTP server
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// serveSMTP answers one SMTP session on l, enough of protocol for net/smtp client
+func serveSMTP(l net.Listener, received chan<- smtpMessage) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		io.WriteString(conn, line+"\r\n")
+	}
+
+	var msg smtpMessage
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg.from = strings.Trim(line[len("MAIL FROM:"):strings.Index(line, ">")+1], "<> ")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			msg.data = data.String()
+			received <- msg
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPSinkDeliversMessage(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan smtpMessage, 1)
+	go serveSMTP(l, received)
+
+	Config.FeedbackMailTo = "support@example.com"
+	Config.FeedbackMailFrom = ""
+	Config.FeedbackMailSubject = "Whistler feedback"
+	Config.FeedbackMailSMTPHost = "127.0.0.1"
+	Config.FeedbackMailSMTPPort = l.Addr().(*net.TCPAddr).Port
+	Config.FeedbackMailTLS = MailTLSNone
+	Config.FeedbackMailAuth = MailAuthNone
+	Config.FeedbackMailDKIMDomain = ""
+	mailSigner = nil
+
+	err = configureFeedbackMail()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&smtpSink{}).Send(testFeedback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+
+	if msg.from != "support@example.com" || len(msg.to) != 1 || msg.to[0] != "support@example.com" {
+		t.Errorf("unexpected envelope from %q to %v", msg.from, msg.to)
+	}
+
+	for _, expected := range []string{
+		"Subject: Whistler feedback [bug] WH-AB3D-9KXZ",
+		"Reply-To: jane@example.com",
+		"Message: App crashes on upload",
+	} {
+		if !strings.Contains(msg.data, expected) {
+			t.Errorf("message does not contain %q:\n%s", expected, msg.data)
+		}
+	}
+}
+
+func TestSMTPSinkDKIMEnvelopeSender(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, err := ioutil.TempFile("", "dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan smtpMessage, 1)
+	go serveSMTP(l, received)
+
+	Config.FeedbackMailTo = "support@example.com"
+	Config.FeedbackMailFrom = "Whistler <noreply@example.com>"
+	Config.FeedbackMailSubject = "Whistler feedback"
+	Config.FeedbackMailSMTPHost = "127.0.0.1"
+	Config.FeedbackMailSMTPPort = l.Addr().(*net.TCPAddr).Port
+	Config.FeedbackMailTLS = MailTLSNone
+	Config.FeedbackMailAuth = MailAuthNone
+	Config.FeedbackMailDKIMDomain = "example.com"
+	Config.FeedbackMailDKIMSelector = "whistler"
+	Config.FeedbackMailDKIMKeyFile = keyFile.Name()
+	defer func() {
+		Config.FeedbackMailFrom = ""
+		Config.FeedbackMailDKIMDomain = ""
+		mailSigner = nil
+	}()
+
+	err = configureFeedbackMail()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&smtpSink{}).Send(testFeedback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+
+	if msg.from != "noreply@example.com" {
+		t.Errorf("unexpected envelope sender %q", msg.from)
+	}
+	if !strings.HasPrefix(msg.data, "DKIM-Signature:") {
+		t.Errorf("message is not signed:\n%s", msg.data)
+	}
+}
+
+// recordingDriver is database/sql driver that records statements and returns no rows
+type recordingDriver struct {
+	sync.Mutex
+	execs []recordedExec
+}
+
+// recordedExec is statement executed through recordingDriver
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d: d}, nil
+}
+
+func (d *recordingDriver) reset() {
+	d.Lock()
+	d.execs = nil
+	d.Unlock()
+}
+
+// deliveries returns executed statements on feedback_delivery table
+func (d *recordingDriver) deliveries() []recordedExec {
+	d.Lock()
+	defer d.Unlock()
+
+	deliveries := make([]recordedExec, 0)
+	for _, e := range d.execs {
+		if strings.Contains(e.query, "feedback_delivery") {
+			deliveries = append(deliveries, e)
+		}
+	}
+
+	return deliveries
+}
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{d: c.d, query: query}, nil
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	return nil
+}
+
+func (c *recordingConn) Rollback() error {
+	return nil
+}
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error {
+	return nil
+}
+
+func (s *recordingStmt) NumInput() int {
+	return -1
+}
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.Lock()
+	s.d.execs = append(s.d.execs, recordedExec{query: s.query, args: args})
+	s.d.Unlock()
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (r *emptyRows) Columns() []string {
+	return []string{}
+}
+
+func (r *emptyRows) Close() error {
+	return nil
+}
+
+func (r *emptyRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
+
+var testDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", testDriver)
+}
+
+// fakeSink records feedback it got and fails when err is set
+type fakeSink struct {
+	name string
+	err  error
+	sent []string
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) Send(f *Feedback) error {
+	s.sent = append(s.sent, f.UID)
+	return s.err
+}
+
+func TestDeliverRecordsOutcomePerSink(t *testing.T) {
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	DB = db
+	testDriver.reset()
+	Config.FeedbackMaxAttempts = 20
+
+	ok := &fakeSink{name: SinkWebhook}
+	failing := &fakeSink{name: SinkChat, err: errors.New("chat down")}
+
+	feedbackSinks = map[string]FeedbackSink{ok.name: ok, failing.name: failing}
+	defer func() {
+		feedbackSinks = make(map[string]FeedbackSink)
+	}()
+
+	outcomes := make(map[string]string)
+
+	for _, name := range []string{ok.name, failing.name} {
+		q := &queuedDelivery{feedbackID: 7, sink: name, feedback: *testFeedback()}
+
+		err = deliver(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, e := range testDriver.deliveries() {
+		// status is first and sink last argument of delivery updates
+		sink := e.args[len(e.args)-1].(string)
+		if _, seen := outcomes[sink]; seen {
+			t.Errorf("more than one outcome recorded for %s", sink)
+		}
+		outcomes[sink] = e.args[0].(string)
+	}
+
+	if len(outcomes) != 2 || outcomes[ok.name] != FeedbackSent || outcomes[failing.name] != FeedbackPending {
+		t.Errorf("unexpected outcomes %v", outcomes)
+	}
+
+	if len(ok.sent) != 1 || len(failing.sent) != 1 {
+		t.Errorf("expected one send per sink, got %v and %v", ok.sent, failing.sent)
+	}
+}
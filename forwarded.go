@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BuildAMovement/whistler-backend/reflector"
+)
+
+// originKey is context key of origin client reached us at
+type originKey struct{}
+
+// forwardedClientKey is context key of client key reflector forwarded request for
+type forwardedClientKey struct{}
+
+// reflectorSecret verifies Whistler-Forwarded headers, nil trusts no reflector
+var reflectorSecret []byte
+
+var (
+	errNotForwarded     = errors.New("request not forwarded by reflector")
+	errForwardedExpired = errors.New("forwarded headers outside time window")
+	errForwardedInvalid = errors.New("forwarded headers signature mismatch")
+)
+
+// configureReflectorTrust decodes reflector secret from config
+func configureReflectorTrust() error {
+	if len(Config.ReflectorSecret) == 0 {
+		if Config.RequireReflector {
+			return errors.New("REQUIRE_REFLECTOR needs REFLECTOR_FORWARD_SECRET")
+		}
+		return nil
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(Config.ReflectorSecret)
+	if err != nil || len(secret) < 16 {
+		return errors.New("REFLECTOR_FORWARD_SECRET must be base64 of at least 16 bytes")
+	}
+	reflectorSecret = secret
+
+	return nil
+}
+
+// forwardedOrigin verifies signed headers reflector adds and returns scheme and
+// host client asked reflector for, and pseudonymous key of client
+func forwardedOrigin(r *http.Request) (*url.URL, string, error) {
+	proto := r.Header.Get("Whistler-Forwarded-Proto")
+	host := r.Header.Get("Whistler-Forwarded-Host")
+	client := r.Header.Get("Whistler-Forwarded-Client")
+	timestamp := r.Header.Get("Whistler-Forwarded-Time")
+	signature := r.Header.Get("Whistler-Forwarded-Signature")
+
+	if len(signature) == 0 {
+		return nil, "", errNotForwarded
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, reflector.ForwardedMAC(reflectorSecret, proto, host, client, timestamp, r.Method, r.RequestURI)) {
+		return nil, "", errForwardedInvalid
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, "", errForwardedInvalid
+	}
+
+	window := time.Duration(Config.ReflectorWindow) * time.Second
+	if d := time.Since(time.Unix(ts, 0)); d > window || d < -window {
+		return nil, "", errForwardedExpired
+	}
+
+	if (proto != "http" && proto != "https") || len(host) == 0 || strings.ContainsAny(host, "/@ ") {
+		return nil, "", errForwardedInvalid
+	}
+
+	return &url.URL{Scheme: proto, Host: host}, client, nil
+}
+
+// trustReflector wraps handler so requests forwarded by configured reflector
+// carry origin client used, and with REQUIRE_REFLECTOR other requests are refused
+func trustReflector(h http.Handler) http.Handler {
+	if reflectorSecret == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin, client, err := forwardedOrigin(r)
+		if err != nil {
+			if Config.RequireReflector {
+				logNetPrintf(r, "Refused direct request %s: %s\n", r.URL.Path, err)
+				writeError(w, http.StatusForbidden, ErrCodeForbidden, nil)
+				return
+			}
+			if err != errNotForwarded {
+				logNetPrintf(r, "Ignoring forwarded headers: %s\n", err)
+			}
+		} else {
+			ctx := context.WithValue(r.Context(), originKey{}, origin)
+			r = r.WithContext(context.WithValue(ctx, forwardedClientKey{}, client))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestOrigin returns scheme and host client reached us at, from verified
+// reflector headers or from request itself
+func requestOrigin(r *http.Request) *url.URL {
+	if origin, ok := r.Context().Value(originKey{}).(*url.URL); ok {
+		return origin
+	}
+
+	origin := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		origin.Scheme = "https"
+	}
+
+	return origin
+}
+
+// forwardedClient returns key of client verified reflector forwarded request for,
+// empty for direct requests
+func forwardedClient(r *http.Request) string {
+	client, _ := r.Context().Value(forwardedClientKey{}).(string)
+	return client
+}
+
+// moduleBaseURL returns base URL of module packages for request, relative
+// TRAIN_MODLUE_BASE_URL is resolved against request origin
+func moduleBaseURL(r *http.Request) (string, error) {
+	base, err := url.Parse(Config.ModuleBaseURL)
+	if err != nil {
+		return "", err
+	}
+
+	if base.IsAbs() {
+		return base.String(), nil
+	}
+
+	return requestOrigin(r).ResolveReference(base).String(), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// freeSpace is not supported on this platform, -1 disables free space watermark
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxLanguages is most preferred languages taken from client
+const maxLanguages = 10
+
+var rxLanguage = regexp.MustCompile("^[a-z]{2,3}(-[a-z0-9]{2,8})*$")
+
+// normalizeLanguage lowercases language tag and checks it is well formed, returns "" if not
+func normalizeLanguage(tag string) string {
+	tag = strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+	if !rxLanguage.MatchString(tag) {
+		return ""
+	}
+
+	return tag
+}
+
+// parseAcceptLanguage returns language tags from Accept-Language header ordered by preference
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	items := make([]weighted, 0)
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+
+		tag := normalizeLanguage(fields[0])
+		if len(tag) == 0 {
+			continue // also skips "*"
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		if q > 0 {
+			items = append(items, weighted{tag: tag, q: q})
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].q > items[j].q
+	})
+
+	tags := make([]string, 0, len(items))
+	for _, item := range items {
+		tags = append(tags, item.tag)
+	}
+
+	return tags
+}
+
+// requestLanguages returns languages client wants, lang query parameter wins over
+// Accept-Language header. Every tag is followed by its base language as fallback,
+// so "pt-br" also matches "pt".
+func requestLanguages(lang string, acceptLanguage string) []string {
+	var tags []string
+
+	if tag := normalizeLanguage(lang); len(tag) > 0 {
+		tags = []string{tag}
+	} else {
+		tags = parseAcceptLanguage(acceptLanguage)
+	}
+
+	seen := make(map[string]bool)
+	languages := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		candidates := []string{tag}
+		if i := strings.Index(tag, "-"); i > 0 {
+			candidates = append(candidates, tag[:i])
+		}
+
+		for _, candidate := range candidates {
+			if !seen[candidate] && len(languages) < maxLanguages {
+				seen[candidate] = true
+				languages = append(languages, candidate)
+			}
+		}
+	}
+
+	return languages
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -20,14 +20,14 @@ type MediaFileInfo struct {
 }
 
 // NotFound object not found
-var NotFound error
+var NotFound = errors.New("not found")
 
 func handleMediaUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	uid := ps.ByName("uid")
 
 	// validate parameters
 	if !govalidator.IsUUID(uid) {
-		w.WriteHeader(400)
+		writeError(w, 400, ErrCodeBadRequest, nil)
 		return
 	}
 
@@ -35,35 +35,19 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	uploadable, err := isMediaFileUplodable(uid)
 	if err != nil {
 		log.Println("Error opening file", err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
 	if !uploadable {
 		logNetPrintf(r, "Can not upload media %s\n", uid)
-		w.WriteHeader(403)
+		writeError(w, 403, ErrCodeUploadClosed, nil)
 		return
 	}
 
-	out, err := os.OpenFile(path.Join(Config.BaseDir, uid), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	err = appendUpload(r, uid, nil)
 	if err != nil {
-		log.Println("Error opening file", err)
-		w.WriteHeader(500)
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, r.Body)
-	if err != nil {
-		log.Println("Error writing to file", err)
-		w.WriteHeader(500)
-		return
-	}
-
-	err = out.Sync()
-	if err != nil {
-		log.Println("Error syncing file", err)
-		w.WriteHeader(500)
+		writeUploadError(w, err)
 		return
 	}
 
@@ -75,7 +59,7 @@ func handleMediaInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 
 	// validate parameters
 	if !govalidator.IsUUID(uid) {
-		w.WriteHeader(400)
+		writeError(w, 400, ErrCodeBadRequest, nil)
 		return
 	}
 
@@ -83,11 +67,11 @@ func handleMediaInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	_, err := getMediaFile(uid)
 	if err != nil {
 		if err == NotFound {
-			w.WriteHeader(404)
+			writeError(w, 404, ErrCodeNotFound, nil)
 			return
 		}
 		log.Println("Error on getMediaFile", err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
@@ -97,7 +81,7 @@ func handleMediaInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 	if err != nil {
 		if !os.IsNotExist(err) {
 			log.Println("Error on file stat", err)
-			w.WriteHeader(500)
+			writeError(w, 500, ErrCodeInternal, nil)
 			return
 		}
 		fileSize = 0
@@ -119,26 +103,32 @@ func handleMediaDone(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 
 	// validate parameters
 	if !govalidator.IsUUID(uid) {
-		w.WriteHeader(400)
+		writeError(w, 400, ErrCodeBadRequest, nil)
 		return
 	}
 
-	result, err := DB.Exec(`UPDATE media_file SET state = ? WHERE uid = ?`, 30, uid)
+	// check media file is registered before touching storage
+	_, err := getMediaFile(uid)
 	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil) // harvesting possible
+			return
+		}
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
-	ra, err := result.RowsAffected()
+	// move file to blob storage, collapsing it with identical uploads
+	ra, err := completeUpload("media_file", uid, 30)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
 	if ra == 0 {
-		w.WriteHeader(404) // harvesting possible
+		writeError(w, 404, ErrCodeNotFound, nil) // harvesting possible
 		return
 	}
 
@@ -174,12 +164,17 @@ func getMediaFile(uid string) (*MediaFile, error) {
 	return &mediaFile, nil
 }
 
-func logNetPrintf(r *http.Request, format string, v ...interface{}) {
+// remoteAddr returns client address, taking proxy header into account
+func remoteAddr(r *http.Request) string {
 	var addr string
 
 	if addr = r.Header.Get("x-forwarded-for"); addr == "" {
 		addr = r.RemoteAddr
 	}
 
-	log.Printf("["+addr+"] "+format, v)
+	return addr
+}
+
+func logNetPrintf(r *http.Request, format string, v ...interface{}) {
+	log.Printf("["+remoteAddr(r)+"] "+format, v...)
 }
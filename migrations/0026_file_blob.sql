@@ -0,0 +1,23 @@
+-- user-026: content addressed blob storage
+-- Applies on top of baseline schema, run migrations in file name order.
+
+CREATE TABLE IF NOT EXISTS schema_migration (
+	version INT NOT NULL PRIMARY KEY,
+	applied BIGINT NOT NULL
+) ENGINE=InnoDB;
+
+CREATE TABLE file_blob (
+	hash CHAR(64) NOT NULL PRIMARY KEY,
+	size BIGINT NOT NULL,
+	created BIGINT NOT NULL
+) ENGINE=InnoDB;
+
+ALTER TABLE evidence
+	ADD COLUMN blobHash CHAR(64) NULL,
+	ADD INDEX evidence_blobHash (blobHash);
+
+ALTER TABLE media_file
+	ADD COLUMN blobHash CHAR(64) NULL,
+	ADD INDEX media_file_blobHash (blobHash);
+
+INSERT INTO schema_migration (version, applied) VALUES (26, UNIX_TIMESTAMP());
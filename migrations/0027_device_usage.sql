@@ -0,0 +1,10 @@
+-- user-027: per device upload quota, device is reflector signed client key or
+-- client address as returned by rateKey
+
+CREATE TABLE device_usage (
+	device VARCHAR(255) NOT NULL PRIMARY KEY,
+	bytes BIGINT NOT NULL,
+	updated BIGINT NOT NULL
+) ENGINE=InnoDB;
+
+INSERT INTO schema_migration (version, applied) VALUES (27, UNIX_TIMESTAMP());
@@ -0,0 +1,19 @@
+-- user-031: admin API audit log and module publishing
+
+CREATE TABLE admin_audit (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	created BIGINT NOT NULL,
+	actor VARCHAR(255) NOT NULL,
+	action VARCHAR(64) NOT NULL,
+	objectType VARCHAR(64) NOT NULL,
+	objectId BIGINT NOT NULL,
+	data TEXT NULL,
+	INDEX admin_audit_object (objectType, objectId)
+) ENGINE=InnoDB;
+
+-- existing modules were all listed before publishing existed, default 1 keeps
+-- them listed, admin API sets published explicitly for new modules
+ALTER TABLE train_module
+	ADD COLUMN published TINYINT(1) NOT NULL DEFAULT 1;
+
+INSERT INTO schema_migration (version, applied) VALUES (31, UNIX_TIMESTAMP());
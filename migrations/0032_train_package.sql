@@ -0,0 +1,7 @@
+-- user-032: train module packages in blob storage
+
+ALTER TABLE train_module
+	ADD COLUMN packageHash CHAR(64) NULL,
+	ADD INDEX train_module_packageHash (packageHash);
+
+INSERT INTO schema_migration (version, applied) VALUES (32, UNIX_TIMESTAMP());
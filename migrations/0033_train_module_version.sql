@@ -0,0 +1,19 @@
+-- user-033: train module versions and release notes
+
+ALTER TABLE train_module
+	ADD COLUMN version VARCHAR(64) NULL,
+	ADD COLUMN releaseNotes TEXT NULL;
+
+CREATE TABLE train_module_version (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	moduleId BIGINT NOT NULL,
+	version VARCHAR(64) NOT NULL,
+	packageHash CHAR(64) NOT NULL,
+	size BIGINT NOT NULL,
+	releaseNotes TEXT NULL,
+	created BIGINT NOT NULL,
+	INDEX train_module_version_moduleId (moduleId),
+	INDEX train_module_version_packageHash (packageHash)
+) ENGINE=InnoDB;
+
+INSERT INTO schema_migration (version, applied) VALUES (33, UNIX_TIMESTAMP());
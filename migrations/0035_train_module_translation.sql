@@ -0,0 +1,15 @@
+-- user-035: train module descriptions and translations
+
+ALTER TABLE train_module
+	ADD COLUMN description TEXT NULL,
+	ADD COLUMN language VARCHAR(35) NULL;
+
+CREATE TABLE train_module_translation (
+	moduleId BIGINT NOT NULL,
+	lang VARCHAR(35) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	description TEXT NULL,
+	PRIMARY KEY (moduleId, lang)
+) ENGINE=InnoDB;
+
+INSERT INTO schema_migration (version, applied) VALUES (35, UNIX_TIMESTAMP());
@@ -0,0 +1,30 @@
+-- user-037: invite codes unlocking private train modules
+
+CREATE TABLE train_invite (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	code VARCHAR(32) NOT NULL,
+	organizationId BIGINT NOT NULL,
+	expires BIGINT NOT NULL DEFAULT 0,
+	maxUses BIGINT NOT NULL DEFAULT 0,
+	uses BIGINT NOT NULL DEFAULT 0,
+	revoked TINYINT(1) NOT NULL DEFAULT 0,
+	created BIGINT NOT NULL,
+	UNIQUE INDEX train_invite_code (code)
+) ENGINE=InnoDB;
+
+CREATE TABLE train_invite_module (
+	inviteId BIGINT NOT NULL,
+	moduleId BIGINT NOT NULL,
+	PRIMARY KEY (inviteId, moduleId)
+) ENGINE=InnoDB;
+
+CREATE TABLE train_invite_use (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	inviteId BIGINT NOT NULL,
+	tokenHash CHAR(64) NOT NULL,
+	created BIGINT NOT NULL,
+	UNIQUE INDEX train_invite_use_token (tokenHash),
+	INDEX train_invite_use_invite (inviteId)
+) ENGINE=InnoDB;
+
+INSERT INTO schema_migration (version, applied) VALUES (37, UNIX_TIMESTAMP());
@@ -0,0 +1,19 @@
+-- user-038: feedback queued in database
+
+CREATE TABLE feedback (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uid CHAR(36) NOT NULL,
+	name TEXT NULL,
+	email TEXT NULL,
+	message TEXT NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	nextAttempt BIGINT NOT NULL,
+	sent BIGINT NULL,
+	lastError TEXT NULL,
+	created BIGINT NOT NULL,
+	UNIQUE INDEX feedback_uid (uid),
+	INDEX feedback_status (status, nextAttempt)
+) ENGINE=InnoDB;
+
+INSERT INTO schema_migration (version, applied) VALUES (38, UNIX_TIMESTAMP());
@@ -0,0 +1,30 @@
+-- user-039: feedback delivery state per sink
+
+CREATE TABLE feedback_delivery (
+	feedbackId BIGINT NOT NULL,
+	sink VARCHAR(32) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	nextAttempt BIGINT NOT NULL,
+	sent BIGINT NULL,
+	lastError TEXT NULL,
+	PRIMARY KEY (feedbackId, sink),
+	INDEX feedback_delivery_status (status, nextAttempt)
+) ENGINE=InnoDB;
+
+-- feedback queued before sinks existed was sent by mail
+INSERT INTO feedback_delivery (
+	feedbackId, sink, status, attempts, nextAttempt, sent, lastError
+) SELECT
+	id, 'smtp', status, attempts, nextAttempt, sent, lastError
+FROM feedback;
+
+ALTER TABLE feedback
+	DROP INDEX feedback_status,
+	DROP COLUMN status,
+	DROP COLUMN attempts,
+	DROP COLUMN nextAttempt,
+	DROP COLUMN sent,
+	DROP COLUMN lastError;
+
+INSERT INTO schema_migration (version, applied) VALUES (39, UNIX_TIMESTAMP());
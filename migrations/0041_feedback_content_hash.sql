@@ -0,0 +1,7 @@
+-- user-041: duplicate feedback detection
+
+ALTER TABLE feedback
+	ADD COLUMN contentHash CHAR(64) NULL,
+	ADD INDEX feedback_contentHash (contentHash, created);
+
+INSERT INTO schema_migration (version, applied) VALUES (41, UNIX_TIMESTAMP());
@@ -0,0 +1,23 @@
+-- user-042: feedback tickets, categories, device info, handling and screenshots
+
+ALTER TABLE feedback
+	ADD COLUMN ticket VARCHAR(16) NULL,
+	ADD COLUMN category VARCHAR(16) NOT NULL DEFAULT 'other',
+	ADD COLUMN device TEXT NULL,
+	ADD COLUMN handled TINYINT(1) NOT NULL DEFAULT 0,
+	ADD COLUMN handledAt BIGINT NULL,
+	ADD UNIQUE INDEX feedback_ticket (ticket),
+	ADD INDEX feedback_handled (handled, id);
+
+CREATE TABLE feedback_attachment (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	feedbackId BIGINT NOT NULL,
+	name VARCHAR(100) NOT NULL,
+	contentType VARCHAR(64) NOT NULL,
+	size BIGINT NOT NULL,
+	blobHash CHAR(64) NOT NULL,
+	INDEX feedback_attachment_feedbackId (feedbackId),
+	INDEX feedback_attachment_blobHash (blobHash)
+) ENGINE=InnoDB;
+
+INSERT INTO schema_migration (version, applied) VALUES (42, UNIX_TIMESTAMP());
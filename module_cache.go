@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxModuleCacheEntries bounds cache, keys come from client queries
+const maxModuleCacheEntries = 1000
+
+// moduleCacheEntry is encoded module catalog response
+type moduleCacheEntry struct {
+	body         []byte
+	next         int64 // cursor of next page, 0 when this is last one
+	etag         string
+	lastModified time.Time
+	stored       time.Time
+}
+
+// fresh checks entry is younger than MODULE_CACHE_TTL, so modules changed directly
+// in database are picked up
+func (e *moduleCacheEntry) fresh(now time.Time) bool {
+	return now.Sub(e.stored) < time.Duration(Config.ModuleCacheTTL)*time.Second
+}
+
+// moduleCache holds encoded catalog responses until modules change
+type moduleCache struct {
+	sync.RWMutex
+	entries    map[string]*moduleCacheEntry
+	modified   time.Time // when modules last changed, as far as we know
+	generation uint64    // bumped on invalidation, so stale loads are not stored
+}
+
+var modulesCache = &moduleCache{
+	entries:  make(map[string]*moduleCacheEntry),
+	modified: time.Now().UTC().Truncate(time.Second),
+}
+
+// get returns fresh entry under key, nil if there is none
+func (c *moduleCache) get(key string) (*moduleCacheEntry, uint64) {
+	c.RLock()
+	defer c.RUnlock()
+
+	entry := c.entries[key]
+	if entry != nil && !entry.fresh(time.Now()) {
+		entry = nil
+	}
+
+	return entry, c.generation
+}
+
+// set stores body loaded in given generation, entry is returned even if it is not stored
+func (c *moduleCache) set(key string, body []byte, next int64, generation uint64) *moduleCacheEntry {
+	sum := sha256.Sum256(body)
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	entry := &moduleCacheEntry{
+		body:         body,
+		next:         next,
+		etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+		lastModified: c.modified,
+		stored:       now,
+	}
+
+	// expired entry with other content means modules changed behind our back
+	if old := c.entries[key]; old != nil && old.etag != entry.etag && now.After(c.modified) {
+		entry.lastModified = now.UTC().Truncate(time.Second)
+	}
+
+	if generation != c.generation {
+		return entry
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxModuleCacheEntries {
+		c.evict(now)
+	}
+	c.entries[key] = entry
+
+	return entry
+}
+
+// evict drops expired entries, or oldest entry when none expired, caller holds lock
+func (c *moduleCache) evict(now time.Time) {
+	var oldestKey string
+	var oldest *moduleCacheEntry
+
+	for key, entry := range c.entries {
+		if !entry.fresh(now) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.stored.Before(oldest.stored) {
+			oldestKey, oldest = key, entry
+		}
+	}
+
+	if len(c.entries) >= maxModuleCacheEntries && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// invalidateModuleCache drops cached catalog, must be called after any module or
+// organization change is committed
+func invalidateModuleCache() {
+	modulesCache.Lock()
+	defer modulesCache.Unlock()
+
+	modulesCache.entries = make(map[string]*moduleCacheEntry)
+	modulesCache.modified = time.Now().UTC().Truncate(time.Second)
+	modulesCache.generation++
+}
+
+// serveModulesCached writes catalog response cached under key, loading it with load
+// on miss. Next page cursor returned by load is cached with the body, Link header
+// is built from current request, as key does not hold its raw query. Responses
+// carry ETag and Last-Modified and 304 is returned to conditional requests, so
+// clients on metered connections do not download unchanged catalog.
+func serveModulesCached(w http.ResponseWriter, r *http.Request, key string,
+	load func() (interface{}, int64, error)) {
+	entry, generation := modulesCache.get(key)
+
+	if entry == nil {
+		data, next, err := load()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		var body bytes.Buffer
+		err = json.NewEncoder(&body).Encode(data)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		entry = modulesCache.set(key, body.Bytes(), next, generation)
+	}
+
+	if entry.next > 0 {
+		next := *r.URL
+		query := next.Query()
+		query.Set("cursor", strconv.FormatInt(entry.next, 10))
+		next.RawQuery = query.Encode()
+
+		w.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+	}
+
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Last-Modified", entry.lastModified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if notModified(r, entry) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(entry.body)
+}
+
+// notModified checks conditional request headers, If-None-Match wins over If-Modified-Since
+func notModified(r *http.Request, entry *moduleCacheEntry) bool {
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		for _, etag := range strings.Split(inm, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == "*" || etag == entry.etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); len(ims) > 0 {
+		t, err := http.ParseTime(ims)
+		if err == nil && !entry.lastModified.After(t) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxQuotaReports is how many latest reports quota usage lists
+	maxQuotaReports = 100
+)
+
+var (
+	// errQuotaExceeded client pushed more than its uid, report or device quota
+	errQuotaExceeded = errors.New("quota exceeded")
+	// errStorageFull free space on BaseDir dropped to watermark
+	errStorageFull = errors.New("storage full")
+)
+
+// QuotaLimits configured upload limits in bytes, 0 means unlimited
+type QuotaLimits struct {
+	UID     int64 `json:"uid"`
+	Report  int64 `json:"report"`
+	Device  int64 `json:"device"`
+	MinFree int64 `json:"minFree"`
+}
+
+// DeviceUsage bytes uploaded by single device identity
+type DeviceUsage struct {
+	Device  string `json:"device"`
+	Bytes   int64  `json:"bytes"`
+	Updated int64  `json:"updated"`
+}
+
+// UIDUsage bytes uploaded for single evidence or media file uid
+type UIDUsage struct {
+	UID   string `json:"uid"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ReportUsage bytes uploaded for all evidences of report
+type ReportUsage struct {
+	ReportID int64 `json:"reportId"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// QuotaUsage returned to admins
+type QuotaUsage struct {
+	Limits    QuotaLimits   `json:"limits"`
+	FreeBytes int64         `json:"freeBytes"`
+	UIDs      []UIDUsage    `json:"uids"`
+	Reports   []ReportUsage `json:"reports"`
+	Devices   []DeviceUsage `json:"devices"`
+}
+
+// allowance is number of bytes client may still upload and error returned
+// when it is exceeded
+type allowance struct {
+	bytes int64 // negative means unlimited
+	err   error
+}
+
+// restrict lowers allowance to bytes if it is tighter than current one
+func (a *allowance) restrict(bytes int64, err error) {
+	if bytes < 0 {
+		bytes = 0
+	}
+
+	if a.bytes < 0 || bytes < a.bytes {
+		a.bytes = bytes
+		a.err = err
+	}
+}
+
+// reader wraps body so reading past allowance fails mid-stream
+func (a *allowance) reader(body io.Reader) io.Reader {
+	if a.bytes < 0 {
+		return body
+	}
+
+	return &quotaReader{r: body, remaining: a.bytes, err: a.err}
+}
+
+// quotaReader passes at most remaining bytes and fails with err if body has more
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	// read one byte over so we know if body is longer than allowed
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1]
+	}
+
+	n, err := q.r.Read(p)
+	if int64(n) > q.remaining {
+		n = int(q.remaining)
+		q.remaining = 0
+		return n, q.err
+	}
+
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// writeUploadError writes error envelope for error returned by appendUpload
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case errQuotaExceeded:
+		writeError(w, http.StatusRequestEntityTooLarge, ErrCodeQuotaExceeded, nil)
+	case errStorageFull:
+		writeError(w, http.StatusInsufficientStorage, ErrCodeStorageFull, nil)
+	default:
+		writeInternalError(w, err)
+	}
+}
+
+// fileSize returns size of uploaded file with uid, 0 if there is none yet
+func fileSize(uid string) (int64, error) {
+	stat, err := os.Stat(path.Join(Config.BaseDir, uid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return stat.Size(), nil
+}
+
+// reportUsage returns bytes uploaded for all evidences of report
+func reportUsage(reportID int64) (int64, error) {
+	rows, err := DB.Query(`SELECT DISTINCT uid FROM evidence WHERE reportId = ?`, reportID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var usage int64
+
+	for rows.Next() {
+		var uid string
+
+		err = rows.Scan(&uid)
+		if err != nil {
+			return 0, err
+		}
+
+		size, err := fileSize(uid)
+		if err != nil {
+			return 0, err
+		}
+
+		usage += size
+	}
+
+	return usage, rows.Err()
+}
+
+// evidenceReports returns ids of reports evidence with uid is attached to
+func evidenceReports(uid string) ([]int64, error) {
+	rows, err := DB.Query(`SELECT reportId FROM evidence WHERE uid = ?`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reportIDs := make([]int64, 0)
+
+	for rows.Next() {
+		var reportID int64
+
+		err = rows.Scan(&reportID)
+		if err != nil {
+			return nil, err
+		}
+
+		reportIDs = append(reportIDs, reportID)
+	}
+
+	return reportIDs, rows.Err()
+}
+
+// deviceIdent returns identity device quota is counted against, client key signed
+// by reflector or client address. Whistler-Device header is not used, client could
+// send new value to get fresh quota.
+func deviceIdent(r *http.Request) string {
+	return rateKey(r)
+}
+
+// deviceUsage returns bytes device uploaded so far
+func deviceUsage(device string) (int64, error) {
+	var usage int64
+
+	row := DB.QueryRow(`SELECT bytes FROM device_usage WHERE device = ?`, device)
+	err := row.Scan(&usage)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return usage, nil
+}
+
+// addDeviceUsage counts uploaded bytes against device quota
+func addDeviceUsage(device string, bytes int64) {
+	if bytes == 0 {
+		return
+	}
+
+	_, err := DB.Exec(`
+		INSERT INTO device_usage (
+			device, bytes, updated
+		) VALUES (
+			?, ?, ?
+		)
+		ON DUPLICATE KEY UPDATE
+			bytes = bytes + VALUES(bytes), updated = VALUES(updated)`, device, bytes, time.Now().UTC().Unix())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// uploadAllowance returns how many bytes device can still append to file uid.
+// Report quota is checked for every report listed in reportIDs.
+func uploadAllowance(device string, uid string, reportIDs []int64) (*allowance, error) {
+	a := &allowance{bytes: -1}
+
+	if Config.QuotaUIDBytes > 0 {
+		size, err := fileSize(uid)
+		if err != nil {
+			return nil, err
+		}
+		a.restrict(Config.QuotaUIDBytes-size, errQuotaExceeded)
+	}
+
+	if Config.QuotaReportBytes > 0 {
+		for _, reportID := range reportIDs {
+			usage, err := reportUsage(reportID)
+			if err != nil {
+				return nil, err
+			}
+			a.restrict(Config.QuotaReportBytes-usage, errQuotaExceeded)
+		}
+	}
+
+	if Config.QuotaDeviceBytes > 0 {
+		usage, err := deviceUsage(device)
+		if err != nil {
+			return nil, err
+		}
+		a.restrict(Config.QuotaDeviceBytes-usage, errQuotaExceeded)
+	}
+
+	if Config.MinFreeBytes > 0 {
+		free, err := freeSpace(Config.BaseDir)
+		if err != nil {
+			return nil, err
+		}
+		if free >= 0 {
+			a.restrict(free-Config.MinFreeBytes, errStorageFull)
+		}
+	}
+
+	return a, nil
+}
+
+// appendUpload appends request body to file uid within allowance. It returns
+// errQuotaExceeded or errStorageFull if allowance was exhausted.
+func appendUpload(r *http.Request, uid string, reportIDs []int64) error {
+	device := deviceIdent(r)
+
+	quota, err := uploadAllowance(device, uid, reportIDs)
+	if err != nil {
+		return err
+	}
+
+	if quota.bytes == 0 {
+		logNetPrintf(r, "Upload of %s rejected, %s\n", uid, quota.err)
+		return quota.err
+	}
+
+	out, err := os.OpenFile(path.Join(Config.BaseDir, uid), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	written, err := io.Copy(out, quota.reader(r.Body))
+	addDeviceUsage(device, written)
+
+	if err != nil {
+		if err == errQuotaExceeded || err == errStorageFull {
+			logNetPrintf(r, "Upload of %s stopped, %s\n", uid, err)
+			out.Sync()
+		}
+		return err
+	}
+
+	return out.Sync()
+}
+
+// recentReports returns ids of latest reports
+func recentReports(limit int) ([]int64, error) {
+	rows, err := DB.Query(`SELECT id FROM report ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reportIDs := make([]int64, 0)
+
+	for rows.Next() {
+		var reportID int64
+
+		err = rows.Scan(&reportID)
+		if err != nil {
+			return nil, err
+		}
+
+		reportIDs = append(reportIDs, reportID)
+	}
+
+	return reportIDs, rows.Err()
+}
+
+// deviceUsages returns usage of device, or of biggest uploaders when device is empty
+func deviceUsages(device string, limit int) ([]DeviceUsage, error) {
+	var rows *sql.Rows
+	var err error
+
+	if len(device) > 0 {
+		rows, err = DB.Query(`SELECT device, bytes, updated FROM device_usage WHERE device = ?`, device)
+	} else {
+		rows, err = DB.Query(`SELECT device, bytes, updated FROM device_usage ORDER BY bytes DESC LIMIT ?`, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := make([]DeviceUsage, 0)
+
+	for rows.Next() {
+		var u DeviceUsage
+
+		err = rows.Scan(&u.Device, &u.Bytes, &u.Updated)
+		if err != nil {
+			return nil, err
+		}
+
+		usages = append(usages, u)
+	}
+
+	return usages, rows.Err()
+}
+
+// handleQuotaUsage returns limits, free space and usage of uid given in uid query
+// parameter and of its reports, of report given in report parameter, or of latest
+// reports when neither is given. Devices lists device given in device parameter,
+// or biggest uploaders.
+func handleQuotaUsage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	usage := &QuotaUsage{
+		Limits: QuotaLimits{
+			UID:     Config.QuotaUIDBytes,
+			Report:  Config.QuotaReportBytes,
+			Device:  Config.QuotaDeviceBytes,
+			MinFree: Config.MinFreeBytes,
+		},
+		UIDs:    make([]UIDUsage, 0),
+		Reports: make([]ReportUsage, 0),
+		Devices: make([]DeviceUsage, 0),
+	}
+
+	free, err := freeSpace(Config.BaseDir)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	usage.FreeBytes = free
+
+	var reportIDs []int64
+
+	query := r.URL.Query()
+
+	switch {
+	case len(query.Get("uid")) > 0:
+		uid := query.Get("uid")
+		if !govalidator.IsUUID(uid) {
+			writeError(w, 400, ErrCodeValidation, map[string]string{"uid": "not a uuid"})
+			return
+		}
+
+		size, err := fileSize(uid)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		usage.UIDs = append(usage.UIDs, UIDUsage{UID: uid, Bytes: size})
+
+		reportIDs, err = evidenceReports(uid)
+	case len(query.Get("report")) > 0:
+		reportID, perr := strconv.ParseInt(query.Get("report"), 10, 64)
+		if perr != nil {
+			writeError(w, 400, ErrCodeValidation, map[string]string{"report": "not a number"})
+			return
+		}
+		reportIDs = []int64{reportID}
+	default:
+		reportIDs, err = recentReports(maxQuotaReports)
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	for _, reportID := range reportIDs {
+		bytes, err := reportUsage(reportID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		usage.Reports = append(usage.Reports, ReportUsage{ReportID: reportID, Bytes: bytes})
+	}
+
+	usage.Devices, err = deviceUsages(query.Get("device"), maxQuotaReports)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,217 @@
+package reflector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenHeader carries client token, see Auth
+	tokenHeader = "Whistler-Token"
+	// defaultTokenWindow is how far token time can be from reflector clock, short
+	// so nonce stores which forget early leave little room for replay
+	defaultTokenWindow = time.Minute
+	// nonceCleanupInterval is how often expired nonces are dropped
+	nonceCleanupInterval = time.Minute
+)
+
+var (
+	errNoToken       = errors.New("no token")
+	errInvalidToken  = errors.New("invalid token")
+	errUnknownKey    = errors.New("unknown token key")
+	errTokenExpired  = errors.New("token outside time window")
+	errTokenReplayed = errors.New("token already used")
+)
+
+// Auth checks Whistler-Token header of client requests. Token is
+// "keyID.timestamp.nonce.mac" where timestamp is unix time, nonce is random
+// base64url string (16 to 64 chars) and mac is base64url HMAC-SHA256 with key
+// keyID of "keyID.timestamp.nonce.METHOD.target", target being Whistler-Route
+// header when sent, else Whistler-Host header, else Host of domain fronted
+// request. Several keys can be
+// valid at once so they can be rotated, each token is accepted only once.
+type Auth struct {
+	keys   map[string][]byte
+	window time.Duration
+	// Nonces remembers used nonces, default one is per process so with several
+	// instances token can be replayed on other instance or after restart
+	Nonces NonceStore
+}
+
+// NonceStore remembers used token nonces. Add records nonce until expires and
+// returns false when nonce was already recorded, it must be atomic.
+type NonceStore interface {
+	Add(r *http.Request, nonce string, expires time.Time) (bool, error)
+}
+
+// memoryNonces is NonceStore of single process
+type memoryNonces struct {
+	mu          sync.Mutex
+	nonces      map[string]int64 // nonce to unix time it can be forgotten
+	lastCleanup time.Time
+}
+
+// NewMemoryNonces creates NonceStore keeping nonces in process memory
+func NewMemoryNonces() NonceStore {
+	return &memoryNonces{nonces: make(map[string]int64)}
+}
+
+func (m *memoryNonces) Add(r *http.Request, nonce string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastCleanup) > nonceCleanupInterval {
+		for n, exp := range m.nonces {
+			if exp < now.Unix() {
+				delete(m.nonces, n)
+			}
+		}
+		m.lastCleanup = now
+	}
+
+	if _, used := m.nonces[nonce]; used {
+		return false, nil
+	}
+	m.nonces[nonce] = expires.Unix()
+
+	return true, nil
+}
+
+// LoadAuth creates Auth from REFLECTOR_KEYS, comma separated "keyID:base64key"
+// pairs, and REFLECTOR_TOKEN_WINDOW in seconds. It returns nil when no keys are
+// set, meaning reflector is open.
+func LoadAuth() (*Auth, error) {
+	rawKeys := os.Getenv("REFLECTOR_KEYS")
+	if len(rawKeys) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[string][]byte)
+
+	for _, pair := range strings.Split(rawKeys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || strings.Contains(parts[0], ".") {
+			return nil, fmt.Errorf("REFLECTOR_KEYS: invalid key %q", parts[0])
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("REFLECTOR_KEYS: key %q must be base64 of at least 16 bytes", parts[0])
+		}
+
+		keys[parts[0]] = key
+	}
+
+	window, err := loadTokenWindow()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAuth(keys, window), nil
+}
+
+// loadTokenWindow reads REFLECTOR_TOKEN_WINDOW in seconds
+func loadTokenWindow() (time.Duration, error) {
+	raw := os.Getenv("REFLECTOR_TOKEN_WINDOW")
+	if len(raw) == 0 {
+		return defaultTokenWindow, nil
+	}
+
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("REFLECTOR_TOKEN_WINDOW: invalid value %q", raw)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// NewAuth creates Auth accepting tokens signed with any of keys
+func NewAuth(keys map[string][]byte, window time.Duration) *Auth {
+	return &Auth{
+		keys:   keys,
+		window: window,
+		Nonces: NewMemoryNonces(),
+	}
+}
+
+// tokenMAC computes token mac for request
+func tokenMAC(key []byte, keyID, timestamp, nonce string, r *http.Request) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyID + "." + timestamp + "." + nonce + "." + r.Method + "." + routeTarget(r)))
+
+	return mac.Sum(nil)
+}
+
+// Sign returns token for request signed with key keyID, for Go clients and tools
+func (a *Auth) Sign(r *http.Request, keyID string, nonce string, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := tokenMAC(a.keys[keyID], keyID, timestamp, nonce, r)
+
+	return keyID + "." + timestamp + "." + nonce + "." + base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// Check verifies request token and remembers its nonce
+func (a *Auth) Check(r *http.Request) error {
+	token := r.Header.Get(tokenHeader)
+	if len(token) == 0 {
+		return errNoToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return errInvalidToken
+	}
+	keyID, timestamp, nonce := parts[0], parts[1], parts[2]
+
+	key, ok := a.keys[keyID]
+	if !ok {
+		return errUnknownKey
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > a.window || d < -a.window {
+		return errTokenExpired
+	}
+
+	if len(nonce) < 16 || len(nonce) > 64 {
+		return errInvalidToken
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(nonce); err != nil {
+		return errInvalidToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil || !hmac.Equal(mac, tokenMAC(key, keyID, timestamp, nonce, r)) {
+		return errInvalidToken
+	}
+
+	return a.useNonce(r, keyID+"."+nonce, ts)
+}
+
+// useNonce remembers nonce until token with it can not be valid anymore
+func (a *Auth) useNonce(r *http.Request, nonce string, ts int64) error {
+	added, err := a.Nonces.Add(r, nonce, time.Unix(ts, 0).Add(a.window))
+	if err != nil {
+		return err
+	}
+	if !added {
+		return errTokenReplayed
+	}
+
+	return nil
+}
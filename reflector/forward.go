@@ -0,0 +1,67 @@
+package reflector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// forwardedPrefix starts headers telling backend where client request went
+const forwardedPrefix = "Whistler-Forwarded-"
+
+// ForwardedMAC computes Whistler-Forwarded-Signature, HMAC-SHA256 of proto, host,
+// client, time, method and request URI joined with newlines. Backend verifies it
+// with same secret.
+func ForwardedMAC(secret []byte, proto, host, client, timestamp, method, requestURI string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{proto, host, client, timestamp, method, requestURI}, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// clientIP returns address of client, from header platform front end sets when
+// configured, else from connection
+func clientIP(r *http.Request, header string) string {
+	if len(header) > 0 {
+		if ip := strings.TrimSpace(r.Header.Get(header)); len(ip) > 0 {
+			return ip
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// clientKey is pseudonymous key of client address, backend rate limits by it
+// without learning the address
+func clientKey(secret []byte, ip string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("client\n" + ip))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// signForwarded adds signed headers with public scheme and host client asked
+// for and client key, so backend can trust reflector, build URLs clients can
+// reach and rate limit clients separately
+func signForwarded(c *http.Request, r *http.Request, dest *Destination, options *Options, now time.Time) {
+	proto := dest.Public.Scheme
+	host := dest.Public.Host
+	client := clientKey(options.ForwardSecret, clientIP(r, options.ClientIPHeader))
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := ForwardedMAC(options.ForwardSecret, proto, host, client, timestamp, c.Method, c.URL.RequestURI())
+
+	c.Header.Set(forwardedPrefix+"Proto", proto)
+	c.Header.Set(forwardedPrefix+"Host", host)
+	c.Header.Set(forwardedPrefix+"Client", client)
+	c.Header.Set(forwardedPrefix+"Time", timestamp)
+	c.Header.Set(forwardedPrefix+"Signature", base64.RawURLEncoding.EncodeToString(mac))
+}
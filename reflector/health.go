@@ -0,0 +1,220 @@
+package reflector
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// failThreshold is number of consecutive failures after which upstream is down
+	failThreshold = 2
+	// minDownTime and maxDownTime bound how long failing upstream is avoided
+	minDownTime = 10 * time.Second
+	maxDownTime = 5 * time.Minute
+	// probeTimeout bounds single active health probe
+	probeTimeout = 5 * time.Second
+)
+
+// upstreamState tracks failures of one upstream
+type upstreamState struct {
+	fails     int
+	downUntil time.Time
+}
+
+// health tracks which upstreams are failing, from failed requests (passive) and
+// from probes (active)
+type health struct {
+	mu     sync.Mutex
+	states map[string]*upstreamState
+}
+
+func newHealth() *health {
+	return &health{states: make(map[string]*upstreamState)}
+}
+
+// report records outcome of request or probe to upstream with key
+func (h *health) report(key string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, found := h.states[key]
+	if !found {
+		if ok {
+			return
+		}
+		state = &upstreamState{}
+		h.states[key] = state
+	}
+
+	if ok {
+		delete(h.states, key)
+		return
+	}
+
+	state.fails++
+	if state.fails >= failThreshold {
+		down := minDownTime << uint(state.fails-failThreshold)
+		if down > maxDownTime || down <= 0 {
+			down = maxDownTime
+		}
+		state.downUntil = time.Now().Add(down)
+	}
+}
+
+// up checks upstream with key is not marked down, caller holds lock
+func (h *health) up(key string, now time.Time) bool {
+	state, found := h.states[key]
+
+	return !found || now.After(state.downUntil)
+}
+
+// order returns backends in order they should be tried, healthy ones first, both
+// groups shuffled by weight. Down backends stay as last resort.
+func (h *health) order(backends []upstreamTarget, weights []int) []upstreamTarget {
+	h.mu.Lock()
+	now := time.Now()
+
+	var healthy, down []int
+	for i, backend := range backends {
+		if h.up(backend.key, now) {
+			healthy = append(healthy, i)
+		} else {
+			down = append(down, i)
+		}
+	}
+	h.mu.Unlock()
+
+	ordered := make([]upstreamTarget, 0, len(backends))
+	for _, group := range [][]int{healthy, down} {
+		for _, i := range weightedShuffle(group, weights) {
+			ordered = append(ordered, backends[i])
+		}
+	}
+
+	return ordered
+}
+
+// weightedShuffle orders indexes randomly, index with higher weight is more likely
+// to come first. Zero weight counts as 1.
+func weightedShuffle(indexes []int, weights []int) []int {
+	left := append([]int{}, indexes...)
+	shuffled := make([]int, 0, len(indexes))
+
+	weight := func(i int) int {
+		if weights[i] <= 0 {
+			return 1
+		}
+		return weights[i]
+	}
+
+	for len(left) > 0 {
+		total := 0
+		for _, i := range left {
+			total += weight(i)
+		}
+
+		n := rand.Intn(total)
+		for j, i := range left {
+			n -= weight(i)
+			if n < 0 {
+				shuffled = append(shuffled, i)
+				left = append(left[:j], left[j+1:]...)
+				break
+			}
+		}
+	}
+
+	return shuffled
+}
+
+// retryable checks request can be sent again to other upstream, only idempotent
+// requests without body are
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return r.ContentLength == 0
+	}
+
+	return false
+}
+
+// upstreamFailed checks response means upstream is broken and other may work
+func upstreamFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// StartHealthChecks probes all fixed (not wildcard) upstreams every interval
+// using transport. It is for standalone reflector, App Engine relies on
+// passive checks only.
+func (h *Hosts) StartHealthChecks(transport http.RoundTripper, interval time.Duration) {
+	go func() {
+		for {
+			h.probe(transport)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// probe checks upstreams once
+func (h *Hosts) probe(transport http.RoundTripper) {
+	config := h.current()
+
+	for _, m := range config.Secrets {
+		for _, up := range m.upstreams() {
+			if strings.HasPrefix(up.Host, "*.") {
+				continue
+			}
+
+			scheme := up.Scheme
+			if len(scheme) == 0 {
+				scheme = "https"
+			}
+
+			backend := upstreamURL(up, &url.URL{Scheme: scheme}, "")
+			h.health.report(upstreamKey(up, ""), probeUpstream(transport, backend, m.HealthPath))
+		}
+	}
+}
+
+// probeUpstream sends GET to health path, any response below 500 means upstream is up
+func probeUpstream(transport http.RoundTripper, backend *url.URL, healthPath string) bool {
+	u := *backend
+	u.Path = healthPath
+	if len(u.Path) == 0 {
+		u.Path = "/"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	return resp.StatusCode < 500
+}
@@ -0,0 +1,450 @@
+package reflector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostsReloadInterval is how often hosts file is checked for changes
+const hostsReloadInterval = 5 * time.Second
+
+// defaultHostsConfig is used when neither REFLECTOR_HOSTS_FILE nor REFLECTOR_HOSTS is set
+var defaultHostsConfig = HostsConfig{
+	Allowed: []HostRule{
+		{Host: "whistlerapp.org"},
+		{Host: "www.whistlerapp.org"},
+	},
+}
+
+// HostsConfig lists where reflector may forward to. Host patterns are exact host
+// names or "*.example.org", which matches any subdomain of example.org.
+type HostsConfig struct {
+	// Secrets map public alias hosts to hidden backends
+	Secrets []SecretMapping `json:"secrets"`
+	// Allowed are public hosts requests can be forwarded to as they are
+	Allowed []HostRule `json:"allowed"`
+	// Fronts route domain fronted requests by their Host, destinations they
+	// route to must still be allowed or secret
+	Fronts []FrontRule `json:"fronts,omitempty"`
+}
+
+// HostRule allows host pattern, optionally only paths under PathPrefix, given
+// Methods and bodies up to MaxBodyBytes. URLs with explicit port other than
+// default of their scheme need rule naming that Port. Several rules for same
+// host allow several paths.
+type HostRule struct {
+	Host         string   `json:"host"`
+	Port         int      `json:"port,omitempty"`
+	PathPrefix   string   `json:"pathPrefix,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	MaxBodyBytes int64    `json:"maxBodyBytes,omitempty"`
+}
+
+// SecretMapping translates alias to hidden backend. When both Alias and Host
+// are wildcards, subdomain of alias is kept, so "*.a.org" to "*.b.net" sends
+// x.a.org to x.b.net. Scheme overrides requested one, backend is reached on
+// Port or default port of scheme, never on port client asked for. Alias URLs
+// with explicit port need AliasPort naming it. Instead of single Host, alias
+// can have several Upstreams to fail over between.
+type SecretMapping struct {
+	Alias      string     `json:"alias"`
+	AliasPort  int        `json:"aliasPort,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	PathPrefix string     `json:"pathPrefix,omitempty"`
+	Scheme     string     `json:"scheme,omitempty"`
+	Port       int        `json:"port,omitempty"`
+	Upstreams  []Upstream `json:"upstreams,omitempty"`
+	// HealthPath is probed on upstreams when active health checks run
+	HealthPath   string   `json:"healthPath,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	MaxBodyBytes int64    `json:"maxBodyBytes,omitempty"`
+}
+
+// Upstream is one backend of secret alias, picked with probability relative to Weight
+type Upstream struct {
+	Host   string `json:"host"`
+	Scheme string `json:"scheme,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Weight int    `json:"weight,omitempty"` // default 1
+}
+
+// upstreams returns mapping upstreams, single Host is upstream too
+func (m *SecretMapping) upstreams() []Upstream {
+	if len(m.Upstreams) > 0 {
+		return m.Upstreams
+	}
+
+	return []Upstream{{Host: m.Host, Scheme: m.Scheme, Port: m.Port}}
+}
+
+// validate checks config for mistakes which would make it match unexpected hosts
+func (c *HostsConfig) validate() error {
+	for _, rule := range c.Allowed {
+		if !validHostPattern(rule.Host) {
+			return fmt.Errorf("invalid allowed host %q", rule.Host)
+		}
+		if rule.MaxBodyBytes < 0 || !validMethods(rule.Methods) {
+			return fmt.Errorf("invalid limits for allowed host %q", rule.Host)
+		}
+		if rule.Port < 0 || rule.Port > 65535 {
+			return fmt.Errorf("invalid port %d for allowed host %q", rule.Port, rule.Host)
+		}
+	}
+
+	for _, m := range c.Secrets {
+		if !validHostPattern(m.Alias) {
+			return fmt.Errorf("invalid secret alias %q", m.Alias)
+		}
+		if m.MaxBodyBytes < 0 || !validMethods(m.Methods) {
+			return fmt.Errorf("invalid limits for secret alias %q", m.Alias)
+		}
+		if m.AliasPort < 0 || m.AliasPort > 65535 {
+			return fmt.Errorf("invalid alias port %d for %q", m.AliasPort, m.Alias)
+		}
+		if len(m.Host) > 0 && len(m.Upstreams) > 0 {
+			return fmt.Errorf("secret alias %q has both host and upstreams", m.Alias)
+		}
+
+		for _, up := range m.upstreams() {
+			if !validHostPattern(up.Host) {
+				return fmt.Errorf("invalid secret mapping %q to %q", m.Alias, up.Host)
+			}
+			if strings.HasPrefix(up.Host, "*.") && !strings.HasPrefix(m.Alias, "*.") {
+				return fmt.Errorf("wildcard secret host %q needs wildcard alias", up.Host)
+			}
+			if up.Scheme != "" && up.Scheme != "http" && up.Scheme != "https" {
+				return fmt.Errorf("invalid scheme %q for %q", up.Scheme, m.Alias)
+			}
+			if up.Port < 0 || up.Port > 65535 {
+				return fmt.Errorf("invalid port %d for %q", up.Port, m.Alias)
+			}
+			if up.Weight < 0 {
+				return fmt.Errorf("negative weight for %q", up.Host)
+			}
+		}
+	}
+
+	for _, f := range c.Fronts {
+		err := f.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validMethods(methods []string) bool {
+	for _, m := range methods {
+		if len(m) == 0 || strings.ToUpper(m) != m || strings.ContainsAny(m, " \t/") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validHostPattern(pattern string) bool {
+	name := strings.TrimPrefix(pattern, "*.")
+
+	return len(name) > 0 && !strings.ContainsAny(name, "*/:@ ")
+}
+
+// matchHost checks host against pattern, returning subdomain matched by wildcard
+func matchHost(pattern, host string) (string, bool) {
+	pattern = strings.ToLower(pattern)
+
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return host[:len(host)-len(suffix)], true
+		}
+		return "", false
+	}
+
+	return "", host == pattern
+}
+
+// explicitPort returns port of u, empty when it is missing or default for scheme
+func explicitPort(u *url.URL) string {
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		return ""
+	}
+
+	return port
+}
+
+// matchPort checks explicit port is one rule names, URLs without one match any rule
+func matchPort(allowed int, port string) bool {
+	return len(port) == 0 || (allowed > 0 && port == strconv.Itoa(allowed))
+}
+
+// matchPath checks cleaned path is prefix or under prefix
+func matchPath(prefix, p string) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// Hosts holds hosts config, reloading it from file when file changes
+type Hosts struct {
+	mu      sync.Mutex
+	file    string
+	config  *HostsConfig
+	modTime time.Time
+	checked time.Time
+	health  *health
+}
+
+// LoadHosts loads hosts config from file named in REFLECTOR_HOSTS_FILE, which is
+// reloaded when it changes, or from JSON in REFLECTOR_HOSTS
+func LoadHosts() (*Hosts, error) {
+	if file := os.Getenv("REFLECTOR_HOSTS_FILE"); len(file) > 0 {
+		h := &Hosts{file: file, health: newHealth()}
+
+		err := h.reload()
+		if err != nil {
+			return nil, err
+		}
+
+		return h, nil
+	}
+
+	config := defaultHostsConfig
+
+	if data := os.Getenv("REFLECTOR_HOSTS"); len(data) > 0 {
+		config = HostsConfig{}
+
+		err := json.Unmarshal([]byte(data), &config)
+		if err != nil {
+			return nil, fmt.Errorf("REFLECTOR_HOSTS: %s", err)
+		}
+	}
+
+	return NewHosts(&config)
+}
+
+// NewHosts creates hosts from fixed config
+func NewHosts(config *HostsConfig) (*Hosts, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Hosts{config: config, health: newHealth()}, nil
+}
+
+// reload reads hosts file if it changed since last load
+func (h *Hosts) reload() error {
+	h.checked = time.Now()
+
+	stat, err := os.Stat(h.file)
+	if err != nil {
+		return err
+	}
+	if h.config != nil && stat.ModTime().Equal(h.modTime) {
+		return nil
+	}
+	// remember even broken file, so error is reported once per change
+	h.modTime = stat.ModTime()
+
+	data, err := ioutil.ReadFile(h.file)
+	if err != nil {
+		return err
+	}
+
+	config := &HostsConfig{}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return fmt.Errorf("%s: %s", h.file, err)
+	}
+
+	err = config.validate()
+	if err != nil {
+		return fmt.Errorf("%s: %s", h.file, err)
+	}
+
+	h.config = config
+
+	return nil
+}
+
+// Refresh reloads hosts file when it changed. On error last good config stays
+// in use, error is returned once per file change.
+func (h *Hosts) Refresh() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.file) == 0 || time.Since(h.checked) < hostsReloadInterval {
+		return nil
+	}
+
+	return h.reload()
+}
+
+// current returns config in use
+func (h *Hosts) current() *HostsConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.config
+}
+
+// ErrURLNotAllowed is returned for URLs reflector does not forward to
+var ErrURLNotAllowed = errors.New("Forward URL not allowed")
+
+// Destination is where reflector forwards request to
+type Destination struct {
+	URL *url.URL
+	// Public is scheme and host client asked for and Backend secret scheme and
+	// host it was translated to, Backend is nil for hosts which are not secret
+	Public  *url.URL
+	Backend *url.URL
+	// Methods and MaxBodyBytes limit requests, zero values mean defaults
+	Methods      []string
+	MaxBodyBytes int64
+	// healthKey identifies upstream Backend belongs to
+	healthKey string
+	// fallbacks are other backends of alias, in order they should be tried
+	fallbacks []upstreamTarget
+}
+
+// upstreamTarget is backend URL of upstream with key its health is tracked by
+type upstreamTarget struct {
+	url *url.URL
+	key string
+}
+
+// next returns destination using next fallback backend, nil if there is none
+func (d *Destination) next() *Destination {
+	if len(d.fallbacks) == 0 {
+		return nil
+	}
+
+	backend := d.fallbacks[0]
+
+	u := *d.URL
+	u.Scheme = backend.url.Scheme
+	u.Host = backend.url.Host
+
+	return &Destination{
+		URL:          &u,
+		Public:       d.Public,
+		Backend:      backend.url,
+		Methods:      d.Methods,
+		MaxBodyBytes: d.MaxBodyBytes,
+		healthKey:    backend.key,
+		fallbacks:    d.fallbacks[1:],
+	}
+}
+
+// upstreamHost returns host name of upstream, sub is subdomain matched by wildcard alias
+func upstreamHost(up Upstream, sub string) string {
+	if strings.HasPrefix(up.Host, "*.") {
+		return sub + up.Host[1:]
+	}
+
+	return up.Host
+}
+
+// upstreamKey identifies upstream by its configured host, scheme and port, so
+// probes and requests with any scheme share health state
+func upstreamKey(up Upstream, sub string) string {
+	return strings.ToLower(upstreamHost(up, sub)) + "|" + up.Scheme + "|" + strconv.Itoa(up.Port)
+}
+
+// upstreamURL returns scheme and host of upstream for request to u, sub is
+// subdomain matched by wildcard alias. Port comes only from upstream config.
+func upstreamURL(up Upstream, u *url.URL, sub string) *url.URL {
+	secretHost := upstreamHost(up, sub)
+
+	backend := &url.URL{Scheme: u.Scheme, Host: secretHost}
+	if up.Port > 0 {
+		backend.Host = net.JoinHostPort(secretHost, strconv.Itoa(up.Port))
+	}
+
+	if len(up.Scheme) > 0 {
+		backend.Scheme = up.Scheme
+	}
+
+	return backend
+}
+
+// Resolve returns destination Whistler reflector will forward rawurl to. Secret
+// alias hosts are translated to their backends, other hosts must be allowed.
+func (h *Hosts) Resolve(rawurl string) (*Destination, error) {
+	config := h.current()
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrURLNotAllowed
+	}
+	if u.User != nil {
+		return nil, ErrURLNotAllowed
+	}
+
+	public := &url.URL{Scheme: u.Scheme, Host: u.Host}
+
+	host := strings.ToLower(u.Hostname())
+	port := explicitPort(u)
+	p := path.Clean("/" + u.Path)
+
+	for _, m := range config.Secrets {
+		sub, ok := matchHost(m.Alias, host)
+		if !ok || !matchPort(m.AliasPort, port) || !matchPath(m.PathPrefix, p) {
+			continue
+		}
+
+		upstreams := m.upstreams()
+		backends := make([]upstreamTarget, 0, len(upstreams))
+		weights := make([]int, 0, len(upstreams))
+
+		for _, up := range upstreams {
+			backends = append(backends, upstreamTarget{url: upstreamURL(up, u, sub), key: upstreamKey(up, sub)})
+			weights = append(weights, up.Weight)
+		}
+
+		dest := &Destination{
+			URL:          u,
+			Public:       public,
+			Methods:      m.Methods,
+			MaxBodyBytes: m.MaxBodyBytes,
+			fallbacks:    h.health.order(backends, weights),
+		}
+
+		return dest.next(), nil
+	}
+
+	for _, rule := range config.Allowed {
+		if _, ok := matchHost(rule.Host, host); ok && matchPort(rule.Port, port) && matchPath(rule.PathPrefix, p) {
+			return &Destination{
+				URL:          u,
+				Public:       public,
+				Methods:      rule.Methods,
+				MaxBodyBytes: rule.MaxBodyBytes,
+			}, nil
+		}
+	}
+
+	return nil, ErrURLNotAllowed
+}
@@ -0,0 +1,176 @@
+package reflector
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMethods are forwarded when destination does not list its own
+var defaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// identifyingHeaders could tell upstream who the client is or that request went
+// through reflector, they are never forwarded
+var identifyingHeaders = map[string]bool{
+	"Forwarded":                true,
+	"Via":                      true,
+	"X-Forwarded-For":          true,
+	"X-Forwarded-Host":         true,
+	"X-Forwarded-Port":         true,
+	"X-Forwarded-Proto":        true,
+	"X-Real-Ip":                true,
+	"X-Client-Ip":              true,
+	"X-Cluster-Client-Ip":      true,
+	"True-Client-Ip":           true,
+	"Cf-Connecting-Ip":         true,
+	"X-Cloud-Trace-Context":    true,
+	"Traceparent":              true,
+	"X-Google-Apps-Metadata":   true,
+	"X-Appengine-Country":      true,
+	"X-Appengine-Region":       true,
+	"X-Appengine-City":         true,
+	"X-Appengine-Citylatlong":  true,
+	"X-Appengine-User-Ip":      true,
+	"X-Appengine-Default-Host": true,
+}
+
+// revealingResponseHeaders could tell client which backend answered
+var revealingResponseHeaders = []string{"Server", "Via", "X-Powered-By", "X-Backend-Server", "X-Served-By"}
+
+// Options tune reflector limits
+type Options struct {
+	// UpstreamTimeout bounds wait for upstream response headers
+	UpstreamTimeout time.Duration
+	// MaxBodyBytes caps request body when destination has no own cap
+	MaxBodyBytes int64
+	// UserAgent replaces client User-Agent, so clients all look the same;
+	// empty keeps client one
+	UserAgent string
+	// DisableHostHeader refuses plaintext Whistler-Host, so only encrypted
+	// routes and fronted requests are served
+	DisableHostHeader bool
+	// ForwardSecret signs Whistler-Forwarded headers, nil sends none
+	ForwardSecret []byte
+	// ClientIPHeader is set by platform front end to client address, empty
+	// uses connection address
+	ClientIPHeader string
+}
+
+// DefaultOptions are used when environment does not override them
+var DefaultOptions = Options{
+	UpstreamTimeout: 30 * time.Second,
+	MaxBodyBytes:    64 << 20,
+	UserAgent:       "Whistler",
+}
+
+// LoadOptions reads REFLECTOR_UPSTREAM_TIMEOUT (seconds), REFLECTOR_MAX_BODY_BYTES,
+// REFLECTOR_USER_AGENT, REFLECTOR_DISABLE_HOST_HEADER, base64
+// REFLECTOR_FORWARD_SECRET and REFLECTOR_CLIENT_IP_HEADER, using DefaultOptions
+// for unset ones
+func LoadOptions() (*Options, error) {
+	options := DefaultOptions
+
+	if raw, ok := os.LookupEnv("REFLECTOR_UPSTREAM_TIMEOUT"); ok {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("REFLECTOR_UPSTREAM_TIMEOUT: invalid value %q", raw)
+		}
+		options.UpstreamTimeout = time.Duration(seconds) * time.Second
+	}
+
+	if raw, ok := os.LookupEnv("REFLECTOR_MAX_BODY_BYTES"); ok {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("REFLECTOR_MAX_BODY_BYTES: invalid value %q", raw)
+		}
+		options.MaxBodyBytes = n
+	}
+
+	if raw, ok := os.LookupEnv("REFLECTOR_USER_AGENT"); ok {
+		options.UserAgent = raw
+	}
+
+	if raw, ok := os.LookupEnv("REFLECTOR_DISABLE_HOST_HEADER"); ok {
+		disable, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("REFLECTOR_DISABLE_HOST_HEADER: invalid value %q", raw)
+		}
+		options.DisableHostHeader = disable
+	}
+
+	if raw := os.Getenv("REFLECTOR_FORWARD_SECRET"); len(raw) > 0 {
+		secret, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil || len(secret) < 16 {
+			return nil, errors.New("REFLECTOR_FORWARD_SECRET must be base64 of at least 16 bytes")
+		}
+		options.ForwardSecret = secret
+	}
+
+	if raw, ok := os.LookupEnv("REFLECTOR_CLIENT_IP_HEADER"); ok {
+		options.ClientIPHeader = http.CanonicalHeaderKey(raw)
+	}
+
+	return &options, nil
+}
+
+// methodAllowed checks method is in destination list, or default list
+func methodAllowed(method string, methods []string) bool {
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripRequestHeaders removes headers identifying client and normalizes User-Agent
+func stripRequestHeaders(h http.Header, userAgent string) {
+	for name := range h {
+		// client must not pass its own forwarded headers off as reflector ones
+		if identifyingHeaders[name] || strings.HasPrefix(name, "X-Appengine-") || strings.HasPrefix(name, forwardedPrefix) {
+			h.Del(name)
+		}
+	}
+
+	if len(userAgent) > 0 {
+		h.Set("User-Agent", userAgent)
+	}
+}
+
+// stripResponseHeaders removes hop-by-hop headers and headers revealing backend
+func stripResponseHeaders(h http.Header) {
+	for name := range stoppedHeaders {
+		h.Del(name)
+	}
+
+	for _, name := range revealingResponseHeaders {
+		h.Del(name)
+	}
+}
+
+// errorPage writes same minimal page for every error, so refused request does
+// not tell what was refused or that there is reflector at all
+func errorPage(w http.ResponseWriter, status int) {
+	h := w.Header()
+	for name := range h {
+		h.Del(name)
+	}
+
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%d %s</title></head><body><h1>%s</h1></body></html>\n",
+		status, http.StatusText(status), http.StatusText(status))
+}
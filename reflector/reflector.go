@@ -0,0 +1,297 @@
+// Package reflector forwards client requests to Whistler hosts named in
+// Whistler-Host header, encrypted Whistler-Route header or by Host of domain
+// fronted request. It only depends on net/http, platform specifics (how
+// upstream requests are made and how errors are logged) are plugged in by
+// appengine wrapper and standalone cmd/reflector.
+package reflector
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// TransportFunc returns round tripper used to forward request r. It is called
+// for every request so platforms which need request scoped transport (App Engine
+// urlfetch) can create one. Transport must not follow redirects.
+type TransportFunc func(r *http.Request) http.RoundTripper
+
+// maxAttempts is most upstreams idempotent request is tried with
+const maxAttempts = 3
+
+// LogFunc logs error which happened while handling request r
+type LogFunc func(r *http.Request, format string, v ...interface{})
+
+// Reflector is http.Handler forwarding requests to allowed Whistler hosts
+type Reflector struct {
+	Hosts     *Hosts
+	Transport TransportFunc
+	Logf      LogFunc
+	// Auth checks client tokens, nil allows any client
+	Auth *Auth
+	// Routes decrypt Whistler-Route header, nil refuses encrypted routes
+	Routes  *RouteKeys
+	Options Options
+}
+
+// New creates reflector forwarding to hosts, using transport to reach them
+func New(hosts *Hosts, transport TransportFunc, logf LogFunc) *Reflector {
+	return &Reflector{
+		Hosts:     hosts,
+		Transport: transport,
+		Logf:      logf,
+		Options:   DefaultOptions,
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// Hop-by-hop headers. These are removed when sent to the backend.
+// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+var stoppedHeaders = map[string]bool{
+	"Whistler-Host":       true,
+	"Whistler-Token":      true,
+	"Whistler-Route":      true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true, // canonicalized version of "TE"
+	"Trailers":            true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// Basic client request check, clients must present valid token when auth is on
+func (rf *Reflector) checkRequest(r *http.Request) error {
+	if rf.Auth == nil {
+		return nil
+	}
+
+	return rf.Auth.Check(r)
+}
+
+// destination gets next host from encrypted route, plaintext host header or
+// fronted Host, in that order, and checks if it is allowed
+func (rf *Reflector) destination(r *http.Request) (*Destination, error) {
+	if blob := r.Header.Get(routeHeader); len(blob) > 0 {
+		if rf.Routes == nil {
+			return nil, errNoRouteKeys
+		}
+
+		fwURL, err := rf.Routes.Open(blob)
+		if err != nil {
+			return nil, err
+		}
+
+		return rf.Hosts.Resolve(fwURL)
+	}
+
+	if fwURL := r.Header.Get("Whistler-Host"); len(fwURL) > 0 {
+		if rf.Options.DisableHostHeader {
+			return nil, errHostHeaderOff
+		}
+
+		return rf.Hosts.Resolve(fwURL)
+	}
+
+	if fwURL := rf.Hosts.frontURL(r); len(fwURL) > 0 {
+		return rf.Hosts.Resolve(fwURL)
+	}
+
+	return nil, errors.New("No Host header in request")
+}
+
+// Make a copy of r for dest, removing the headers in stoppedHeaders and headers
+// identifying client
+func (rf *Reflector) copyRequest(r *http.Request, dest *Destination) (*http.Request, error) {
+	c, err := http.NewRequest(r.Method, dest.URL.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	c = c.WithContext(r.Context())
+	c.ContentLength = r.ContentLength
+
+	for key, values := range r.Header {
+		if stoppedHeaders[key] == false {
+			for _, value := range values {
+				c.Header.Add(key, value)
+			}
+		}
+	}
+
+	stripRequestHeaders(c.Header, rf.Options.UserAgent)
+
+	if len(rf.Options.ForwardSecret) > 0 {
+		signForwarded(c, r, dest, &rf.Options, time.Now())
+	}
+
+	// secret backend responses are rewritten, so they must come uncompressed
+	if dest.Backend != nil {
+		c.Header.Del("Accept-Encoding")
+	}
+
+	return c, nil
+}
+
+// clientBody remembers error reading client request body
+type clientBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+// clientFailed checks request failed because of client, it was canceled or its
+// body could not be read or was over limit
+func clientFailed(r *http.Request) bool {
+	if r.Context().Err() != nil {
+		return true
+	}
+
+	body, ok := r.Body.(*clientBody)
+
+	return ok && body.err != nil
+}
+
+// bodyTooLarge checks request failed because client body went over limit. Some
+// transports return body error as it is, others wrap or replace it.
+func bodyTooLarge(r *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return true
+	}
+
+	body, ok := r.Body.(*clientBody)
+
+	return ok && errors.As(body.err, &tooLarge)
+}
+
+// roundTrip forwards r to dest. Idempotent requests are retried with other
+// upstreams of secret alias when upstream fails. It returns destination which
+// answered.
+func (rf *Reflector) roundTrip(r *http.Request, dest *Destination) (*http.Response, *Destination, error) {
+	transport := rf.Transport(r)
+
+	for attempt := 1; ; attempt++ {
+		fr, err := rf.copyRequest(r, dest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := transport.RoundTrip(fr)
+
+		// upstream is not blamed for client which went away or sent bad body
+		if dest.Backend != nil && !clientFailed(r) {
+			failed := upstreamFailed(resp, err)
+			rf.Hosts.health.report(dest.healthKey, !failed)
+
+			next := dest.next()
+			if failed && next != nil && attempt < maxAttempts && retryable(r) {
+				if err == nil {
+					resp.Body.Close()
+					err = errors.New(resp.Status)
+				}
+				rf.Logf(r, "upstream %s failed, retrying: %s", dest.Backend.Host, err)
+				dest = next
+				continue
+			}
+		}
+
+		return resp, dest, err
+	}
+}
+
+func (rf *Reflector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := rf.checkRequest(r)
+	if err != nil {
+		rf.Logf(r, "checkRequest: %s", err)
+		errorPage(w, http.StatusNotFound)
+		return
+	}
+
+	err = rf.Hosts.Refresh()
+	if err != nil {
+		rf.Logf(r, "hosts reload: %s", err)
+	}
+
+	dest, err := rf.destination(r)
+	if err != nil {
+		rf.Logf(r, "destination: %s", err)
+		errorPage(w, http.StatusNotFound)
+		return
+	}
+
+	if !methodAllowed(r.Method, dest.Methods) {
+		rf.Logf(r, "method %s not allowed for %s", r.Method, dest.Public.Host)
+		errorPage(w, http.StatusNotFound)
+		return
+	}
+
+	maxBody := dest.MaxBodyBytes
+	if maxBody == 0 {
+		maxBody = rf.Options.MaxBodyBytes
+	}
+	if r.ContentLength > maxBody {
+		rf.Logf(r, "body of %d bytes over limit", r.ContentLength)
+		errorPage(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = &clientBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxBody)}
+
+	resp, dest, err := rf.roundTrip(r, dest)
+	if err != nil {
+		rf.Logf(r, "RoundTrip: %s", err)
+		if bodyTooLarge(r, err) {
+			errorPage(w, http.StatusRequestEntityTooLarge)
+		} else {
+			errorPage(w, http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	stripResponseHeaders(resp.Header)
+
+	var body io.WriteCloser
+
+	// do not let secret backend address leak to client
+	if dest.Backend != nil {
+		rewriteHeaders(resp.Header, dest)
+
+		if rewritableBody(resp.Header) {
+			resp.Header.Del("Content-Length")
+			body = newStreamRewriter(w, dest)
+		}
+	}
+
+	copyHeader(w.Header(), resp.Header)
+
+	w.WriteHeader(resp.StatusCode)
+
+	if body == nil {
+		_, err = io.Copy(w, resp.Body)
+	} else {
+		_, err = io.Copy(body, resp.Body)
+		if err == nil {
+			err = body.Close()
+		}
+	}
+	if err != nil {
+		rf.Logf(r, "io.Copy: %s", err)
+	}
+}
@@ -0,0 +1,418 @@
+package reflector
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend is upstream server counting requests it got
+type testBackend struct {
+	*httptest.Server
+	hits int32
+}
+
+func newTestBackend(t *testing.T, handler http.HandlerFunc) *testBackend {
+	b := &testBackend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&b.hits, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(b.Close)
+
+	return b
+}
+
+// port returns port backend listens on
+func (b *testBackend) port(t *testing.T) int {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port
+}
+
+func newTestReflector(t *testing.T, config *HostsConfig) *Reflector {
+	hosts, err := NewHosts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &http.Transport{}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	rf := New(hosts, func(r *http.Request) http.RoundTripper { return transport }, func(r *http.Request, format string, v ...interface{}) {
+		t.Logf(format, v...)
+	})
+
+	return rf
+}
+
+// serve sends r through reflector
+func serve(rf *Reflector, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rf.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestRefusedRequests(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	port := backend.port(t)
+
+	rf := newTestReflector(t, &HostsConfig{
+		Allowed: []HostRule{
+			{Host: "127.0.0.1", Port: port, PathPrefix: "/api", Methods: []string{"GET", "POST"}},
+		},
+	})
+
+	origin := "http://127.0.0.1:" + strconv.Itoa(port)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{"other host", "GET", "http://localhost:" + strconv.Itoa(port) + "/api/x"},
+		{"other port", "GET", "http://127.0.0.1:1/api/x"},
+		{"path outside prefix", "GET", origin + "/apix"},
+		{"path escaping prefix", "GET", origin + "/api/../admin"},
+		{"method", "DELETE", origin + "/api/x"},
+		{"scheme", "GET", "ftp://127.0.0.1:" + strconv.Itoa(port) + "/api/x"},
+		{"user info", "GET", "http://user@127.0.0.1:" + strconv.Itoa(port) + "/api/x"},
+		{"no host", "GET", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/", nil)
+		if len(test.target) > 0 {
+			r.Header.Set("Whistler-Host", test.target)
+		}
+
+		w := serve(rf, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", test.name, w.Code)
+		}
+	}
+
+	if hits := atomic.LoadInt32(&backend.hits); hits != 0 {
+		t.Errorf("backend got %d refused requests", hits)
+	}
+
+	w := serve(rf, func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Whistler-Host", origin+"/api/x")
+		return r
+	}())
+	if w.Code != http.StatusOK {
+		t.Errorf("allowed request: got status %d", w.Code)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	received := make(chan http.Header, 1)
+	requestURI := make(chan string, 1)
+
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		requestURI <- r.RequestURI
+		w.Header().Set("Server", "secret-backend/1.0")
+		w.Header().Set("X-Powered-By", "php")
+	})
+
+	rf := newTestReflector(t, &HostsConfig{
+		Secrets: []SecretMapping{
+			{Alias: "api.example.org", Host: "127.0.0.1", Scheme: "http", Port: backend.port(t)},
+		},
+	})
+	rf.Options.ForwardSecret = secret
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.7:4321"
+	r.Header.Set("Whistler-Host", "https://api.example.org/reports?page=2")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("Via", "1.1 client-proxy")
+	r.Header.Set("X-Appengine-Country", "XX")
+	r.Header.Set("Whistler-Forwarded-Client", "forged")
+	r.Header.Set("User-Agent", "Whistler/1.2 (Android 9; Pixel)")
+	r.Header.Set("Accept", "application/json")
+
+	w := serve(rf, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	h := <-received
+	uri := <-requestURI
+
+	for _, name := range []string{"X-Forwarded-For", "Via", "X-Appengine-Country", "Whistler-Host"} {
+		if value := h.Get(name); len(value) > 0 {
+			t.Errorf("%s forwarded: %q", name, value)
+		}
+	}
+	if ua := h.Get("User-Agent"); ua != "Whistler" {
+		t.Errorf("User-Agent not replaced: %q", ua)
+	}
+	if accept := h.Get("Accept"); accept != "application/json" {
+		t.Errorf("Accept not forwarded: %q", accept)
+	}
+
+	client := h.Get(forwardedPrefix + "Client")
+	if client != clientKey(secret, "192.0.2.7") {
+		t.Errorf("client key %q is not key of connection address", client)
+	}
+	if proto, host := h.Get(forwardedPrefix+"Proto"), h.Get(forwardedPrefix+"Host"); proto != "https" || host != "api.example.org" {
+		t.Errorf("forwarded origin %s://%s", proto, host)
+	}
+
+	mac := ForwardedMAC(secret, h.Get(forwardedPrefix+"Proto"), h.Get(forwardedPrefix+"Host"), client,
+		h.Get(forwardedPrefix+"Time"), "GET", uri)
+	if h.Get(forwardedPrefix+"Signature") != base64.RawURLEncoding.EncodeToString(mac) {
+		t.Errorf("signature does not verify for %s", uri)
+	}
+
+	for _, name := range []string{"Server", "X-Powered-By"} {
+		if value := w.Header().Get(name); len(value) > 0 {
+			t.Errorf("response %s not stripped: %q", name, value)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	rf := newTestReflector(t, &HostsConfig{
+		Allowed: []HostRule{{Host: "127.0.0.1", Port: backend.port(t)}},
+	})
+	rf.Auth = NewAuth(map[string][]byte{"k1": []byte("0123456789abcdef")}, time.Minute)
+
+	request := func(nonce string, now time.Time, sign bool) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Whistler-Host", backend.URL+"/")
+		if sign {
+			r.Header.Set(tokenHeader, rf.Auth.Sign(r, "k1", nonce, now))
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"valid", request("nonce-aaaaaaaaaaaa", time.Now(), true), http.StatusOK},
+		{"replayed", request("nonce-aaaaaaaaaaaa", time.Now(), true), http.StatusNotFound},
+		{"expired", request("nonce-bbbbbbbbbbbb", time.Now().Add(-2*time.Minute), true), http.StatusNotFound},
+		{"future", request("nonce-cccccccccccc", time.Now().Add(2*time.Minute), true), http.StatusNotFound},
+		{"missing", request("", time.Now(), false), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := serve(rf, test.r)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+
+	// token is bound to target it was signed for
+	r := request("nonce-dddddddddddd", time.Now(), true)
+	r.Header.Set("Whistler-Host", backend.URL+"/other")
+	if w := serve(rf, r); w.Code != http.StatusNotFound {
+		t.Errorf("token for other target: got status %d", w.Code)
+	}
+
+	if hits := atomic.LoadInt32(&backend.hits); hits != 1 {
+		t.Errorf("backend got %d requests, want 1", hits)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})
+
+	rf := newTestReflector(t, &HostsConfig{
+		Allowed: []HostRule{{Host: "127.0.0.1", Port: backend.port(t)}},
+	})
+
+	var err error
+	rf.Routes, err = NewRouteKeys(map[string][]byte{"r1": []byte("0123456789abcdef")}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := rf.Routes.Seal("r1", backend.URL+"/sealed", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := rf.Routes.Seal("r1", backend.URL+"/sealed", time.Now().Add(-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+
+	tests := []struct {
+		name  string
+		route string
+		want  int
+	}{
+		{"sealed", sealed, http.StatusOK},
+		{"expired", expired, http.StatusNotFound},
+		{"tampered", tampered, http.StatusNotFound},
+		{"unknown key", "r2" + sealed[2:], http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(routeHeader, test.route)
+		// route wins over plaintext host
+		r.Header.Set("Whistler-Host", backend.URL+"/plain")
+
+		w := serve(rf, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.want)
+		}
+		if test.want == http.StatusOK && w.Body.String() != "/sealed" {
+			t.Errorf("%s: forwarded to %q", test.name, w.Body.String())
+		}
+	}
+
+	rf.Options.DisableHostHeader = true
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Whistler-Host", backend.URL+"/plain")
+	if w := serve(rf, r); w.Code != http.StatusNotFound {
+		t.Errorf("plaintext host with host header disabled: got status %d", w.Code)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	broken := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	var good *testBackend
+	good = newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"self":"`+good.URL+`/x"}`)
+	})
+
+	rf := newTestReflector(t, &HostsConfig{
+		Secrets: []SecretMapping{{
+			Alias: "api.example.org",
+			Upstreams: []Upstream{
+				// broken one is almost surely tried first
+				{Host: "127.0.0.1", Scheme: "http", Port: broken.port(t), Weight: 1000000},
+				{Host: "127.0.0.1", Scheme: "http", Port: good.port(t), Weight: 1},
+			},
+		}},
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Whistler-Host", "https://api.example.org/x")
+
+	w := serve(rf, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if body := w.Body.String(); body != `{"self":"https://api.example.org/x"}` {
+		t.Errorf("backend not rewritten in body %q", body)
+	}
+	if hits := atomic.LoadInt32(&broken.hits); hits != 1 {
+		t.Errorf("broken upstream got %d requests, want 1", hits)
+	}
+
+	// requests with body are not retried
+	r = httptest.NewRequest("POST", "/", strings.NewReader("data"))
+	r.Header.Set("Whistler-Host", "https://api.example.org/x")
+	rf.Hosts.health = newHealth()
+
+	w = serve(rf, r)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("POST to broken upstream: got status %d, want 502", w.Code)
+	}
+	if hits := atomic.LoadInt32(&good.hits); hits != 1 {
+		t.Errorf("POST was retried, good upstream got %d requests", hits)
+	}
+}
+
+func TestStreamedBodyTooLarge(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	})
+
+	rf := newTestReflector(t, &HostsConfig{
+		Allowed: []HostRule{{Host: "127.0.0.1", Port: backend.port(t), MaxBodyBytes: 1024}},
+	})
+
+	// chunked body, length is unknown until it is read
+	r := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(strings.Repeat("x", 4096))))
+	r.ContentLength = -1
+	r.Header.Set("Whistler-Host", backend.URL+"/upload")
+
+	w := serve(rf, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want 413", w.Code)
+	}
+
+	// declared length over limit is refused before upstream is reached
+	hits := atomic.LoadInt32(&backend.hits)
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 4096)))
+	r.Header.Set("Whistler-Host", backend.URL+"/upload")
+
+	w = serve(rf, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared length: got status %d, want 413", w.Code)
+	}
+	if atomic.LoadInt32(&backend.hits) != hits {
+		t.Errorf("request with declared length over limit reached backend")
+	}
+}
+
+func TestSharedNonces(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	config := &HostsConfig{
+		Allowed: []HostRule{{Host: "127.0.0.1", Port: backend.port(t)}},
+	}
+	keys := map[string][]byte{"k1": []byte("0123456789abcdef")}
+	nonces := NewMemoryNonces()
+
+	// two instances sharing nonce store
+	instances := make([]*Reflector, 2)
+	for i := range instances {
+		instances[i] = newTestReflector(t, config)
+		instances[i].Auth = NewAuth(keys, time.Minute)
+		instances[i].Auth.Nonces = nonces
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Whistler-Host", backend.URL+"/")
+	r.Header.Set(tokenHeader, instances[0].Auth.Sign(r, "k1", "nonce-eeeeeeeeeeee", time.Now()))
+
+	replay := r.Clone(r.Context())
+
+	if w := serve(instances[0], r); w.Code != http.StatusOK {
+		t.Fatalf("first use: got status %d", w.Code)
+	}
+	if w := serve(instances[1], replay); w.Code != http.StatusNotFound {
+		t.Errorf("replay on other instance: got status %d, want 404", w.Code)
+	}
+}
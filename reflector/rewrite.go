@@ -0,0 +1,250 @@
+package reflector
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// rewrittenHeaders hold single URL which can point to backend
+var rewrittenHeaders = []string{"Location", "Content-Location"}
+
+// rewriteHeaders replaces secret backend with public alias in response headers
+func rewriteHeaders(h http.Header, dest *Destination) {
+	for _, name := range rewrittenHeaders {
+		if value := h.Get(name); len(value) > 0 {
+			h.Set(name, rewriteURL(value, dest))
+		}
+	}
+
+	if cookies, ok := h["Set-Cookie"]; ok {
+		for i, cookie := range cookies {
+			cookies[i] = rewriteCookieDomain(cookie, dest)
+		}
+	}
+}
+
+// rewriteURL points absolute URL at backend to alias, other URLs are returned as they are
+func rewriteURL(rawurl string, dest *Destination) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || len(u.Host) == 0 {
+		return rawurl
+	}
+
+	if !strings.EqualFold(u.Host, dest.Backend.Host) && !strings.EqualFold(u.Hostname(), dest.Backend.Hostname()) {
+		return rawurl
+	}
+
+	if len(u.Scheme) > 0 {
+		u.Scheme = dest.Public.Scheme
+	}
+	u.Host = dest.Public.Host
+
+	return u.String()
+}
+
+// rewriteCookieDomain replaces backend in cookie Domain attribute with alias. When
+// domain is parent of backend there is no matching parent of alias, attribute is
+// dropped so cookie is bound to alias host only.
+func rewriteCookieDomain(cookie string, dest *Destination) string {
+	backend := strings.ToLower(dest.Backend.Hostname())
+	parts := strings.Split(cookie, ";")
+
+	for i := 1; i < len(parts); i++ {
+		attr := strings.TrimSpace(parts[i])
+		if len(attr) < 7 || !strings.EqualFold(attr[:7], "domain=") {
+			continue
+		}
+
+		domain := strings.ToLower(strings.TrimPrefix(attr[7:], "."))
+
+		switch {
+		case domain == backend:
+			parts[i] = " Domain=" + dest.Public.Hostname()
+		case strings.HasSuffix(backend, "."+domain):
+			parts = append(parts[:i], parts[i+1:]...)
+			i--
+		}
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// rewritableBody checks response body is JSON or HTML we can rewrite
+func rewritableBody(h http.Header) bool {
+	if enc := h.Get("Content-Encoding"); len(enc) > 0 && enc != "identity" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/html" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// bodyReplacements returns backend to alias replacements of origin forms, with
+// scheme or scheme relative, plain and JSON escaped, longest first. Bare host
+// names are left alone, they could be part of unrelated text.
+func bodyReplacements(dest *Destination) [][2][]byte {
+	b, p := dest.Backend, dest.Public
+
+	pairs := map[string]string{
+		b.Scheme + "://" + b.Host:   p.Scheme + "://" + p.Host,
+		b.Scheme + `:\/\/` + b.Host: p.Scheme + `:\/\/` + p.Host,
+		"//" + b.Host:               "//" + p.Host,
+		`\/\/` + b.Host:             `\/\/` + p.Host,
+	}
+
+	replacements := make([][2][]byte, 0, len(pairs))
+	for old, repl := range pairs {
+		if old != repl {
+			replacements = append(replacements, [2][]byte{[]byte(old), []byte(repl)})
+		}
+	}
+
+	sort.Slice(replacements, func(i, j int) bool {
+		return len(replacements[i][0]) > len(replacements[j][0])
+	})
+
+	return replacements
+}
+
+// streamRewriter replaces backend strings in body as it is written, holding back
+// only tail which can be start of match or needs more bytes to decide host boundary
+type streamRewriter struct {
+	w            io.Writer
+	buf          []byte
+	replacements [][2][]byte
+	maxLen       int
+}
+
+func newStreamRewriter(w io.Writer, dest *Destination) *streamRewriter {
+	s := &streamRewriter{
+		w:            w,
+		replacements: bodyReplacements(dest),
+	}
+
+	if len(s.replacements) > 0 {
+		s.maxLen = len(s.replacements[0][0])
+	}
+
+	return s
+}
+
+func (s *streamRewriter) Write(p []byte) (int, error) {
+	if s.maxLen == 0 {
+		return s.w.Write(p)
+	}
+
+	s.buf = append(s.buf, p...)
+
+	return len(p), s.flush(false)
+}
+
+// Close writes held back tail
+func (s *streamRewriter) Close() error {
+	return s.flush(true)
+}
+
+// firstMatch returns earliest match in buf at or after from, longest replacement
+// wins on same position
+func (s *streamRewriter) firstMatch(from int) (int, [2][]byte) {
+	index := -1
+	var match [2][]byte
+
+	for _, r := range s.replacements {
+		i := bytes.Index(s.buf[from:], r[0])
+		if i >= 0 && (index < 0 || from+i < index) {
+			index, match = from+i, r
+		}
+	}
+
+	return index, match
+}
+
+// boundary tells whether host of match ending at end is not followed by more of
+// host name or by port, decided is false when more bytes are needed to tell
+func (s *streamRewriter) boundary(end int, final bool) (ok bool, decided bool) {
+	if end == len(s.buf) {
+		return true, final
+	}
+
+	c := s.buf[end]
+	switch {
+	case isHostByte(c):
+		return false, true
+	case c != ':':
+		return true, true
+	case end+1 == len(s.buf):
+		return true, final
+	}
+
+	next := s.buf[end+1]
+	return next < '0' || next > '9', true
+}
+
+// isHostByte checks c can continue host name
+func isHostByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-'
+}
+
+func (s *streamRewriter) flush(final bool) error {
+	written, from := 0, 0
+
+	for {
+		i, r := s.firstMatch(from)
+		if i < 0 {
+			break
+		}
+
+		end := i + len(r[0])
+		ok, decided := s.boundary(end, final)
+		if !decided {
+			// hold match until byte after it arrives
+			return s.emit(written, i)
+		}
+		if !ok {
+			from = i + 1
+			continue
+		}
+
+		_, err := s.w.Write(s.buf[written:i])
+		if err != nil {
+			return err
+		}
+		_, err = s.w.Write(r[1])
+		if err != nil {
+			return err
+		}
+
+		written, from = end, end
+	}
+
+	// tail shorter than longest match could be start of one not yet received
+	cut := len(s.buf)
+	if !final {
+		cut -= s.maxLen - 1
+	}
+	if cut < written {
+		cut = written
+	}
+
+	return s.emit(written, cut)
+}
+
+// emit writes buf from written to cut and keeps rest of it
+func (s *streamRewriter) emit(written int, cut int) error {
+	_, err := s.w.Write(s.buf[written:cut])
+	if err != nil {
+		return err
+	}
+	s.buf = append(s.buf[:0], s.buf[cut:]...)
+
+	return nil
+}
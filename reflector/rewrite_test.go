@@ -0,0 +1,69 @@
+package reflector
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+)
+
+func testDestination() *Destination {
+	return &Destination{
+		Public:  &url.URL{Scheme: "https", Host: "alias.example.org"},
+		Backend: &url.URL{Scheme: "https", Host: "secret.internal"},
+	}
+}
+
+// rewrite writes body through streamRewriter in chunks of given size
+func rewrite(t *testing.T, body string, chunk int) string {
+	var out bytes.Buffer
+	s := newStreamRewriter(&out, testDestination())
+
+	for i := 0; i < len(body); i += chunk {
+		end := i + chunk
+		if end > len(body) {
+			end = len(body)
+		}
+
+		_, err := s.Write([]byte(body[i:end]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+func TestStreamRewriter(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"url", `<a href="https://secret.internal/a">`, `<a href="https://alias.example.org/a">`},
+		{"json escaped", `{"u":"https:\/\/secret.internal\/a"}`, `{"u":"https:\/\/alias.example.org\/a"}`},
+		{"scheme relative", `<img src="//secret.internal/i.png">`, `<img src="//alias.example.org/i.png">`},
+		{"end of body", `see https://secret.internal`, `see https://alias.example.org`},
+		{"colon without port", `https://secret.internal: down`, `https://alias.example.org: down`},
+		{"colon at end", `https://secret.internal:`, `https://alias.example.org:`},
+		{"longer host", `https://secret.internal.example.com/`, `https://secret.internal.example.com/`},
+		{"host with dash", `//secret.internal-2/`, `//secret.internal-2/`},
+		{"explicit port", `https://secret.internal:8443/`, `https://secret.internal:8443/`},
+		{"bare host", `secret.internal is down`, `secret.internal is down`},
+		{"two matches", `//secret.internal //secret.internal.x //secret.internal`, `//alias.example.org //secret.internal.x //alias.example.org`},
+	}
+
+	for _, test := range tests {
+		for chunk := 1; chunk <= len(test.body); chunk++ {
+			got := rewrite(t, test.body, chunk)
+			if got != test.want {
+				t.Errorf("%s, chunks of %d: got %q, want %q", test.name, chunk, got, test.want)
+				break
+			}
+		}
+	}
+}
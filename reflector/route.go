@@ -0,0 +1,243 @@
+package reflector
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// routeHeader carries encrypted destination, see RouteKeys
+const routeHeader = "Whistler-Route"
+
+var (
+	errInvalidRoute  = errors.New("invalid route")
+	errUnknownRoute  = errors.New("unknown route key")
+	errRouteExpired  = errors.New("route outside time window")
+	errNoRouteKeys   = errors.New("route header without route keys")
+	errHostHeaderOff = errors.New("plaintext host header disabled")
+)
+
+// route is plaintext of routing blob
+type route struct {
+	URL string `json:"url"`
+	// TS is optional unix time, blob without it can be reused, with it only
+	// within window
+	TS int64 `json:"ts,omitempty"`
+}
+
+// RouteKeys decrypt Whistler-Route header, "keyID.blob" where blob is base64url
+// of 12 byte nonce followed by AES-GCM sealed JSON {"url": ..., "ts": ...} with
+// keyID as additional data. Unlike Whistler-Host, observer who sees request
+// headers (e.g. fronting CDN) can not tell which backend it goes to.
+type RouteKeys struct {
+	keys   map[string]cipher.AEAD
+	window time.Duration
+}
+
+// LoadRouteKeys creates RouteKeys from REFLECTOR_ROUTE_KEYS, comma separated
+// "keyID:base64key" pairs with AES-128, 192 or 256 keys. Timestamped blobs are
+// accepted within REFLECTOR_TOKEN_WINDOW. It returns nil when no keys are set.
+func LoadRouteKeys() (*RouteKeys, error) {
+	rawKeys := os.Getenv("REFLECTOR_ROUTE_KEYS")
+	if len(rawKeys) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[string][]byte)
+
+	for _, pair := range strings.Split(rawKeys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || strings.Contains(parts[0], ".") {
+			return nil, fmt.Errorf("REFLECTOR_ROUTE_KEYS: invalid key %q", parts[0])
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("REFLECTOR_ROUTE_KEYS: key %q is not base64", parts[0])
+		}
+
+		keys[parts[0]] = key
+	}
+
+	window, err := loadTokenWindow()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRouteKeys(keys, window)
+}
+
+// NewRouteKeys creates RouteKeys decrypting blobs sealed with any of keys
+func NewRouteKeys(keys map[string][]byte, window time.Duration) (*RouteKeys, error) {
+	rk := &RouteKeys{
+		keys:   make(map[string]cipher.AEAD),
+		window: window,
+	}
+
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("route key %q: %s", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("route key %q: %s", id, err)
+		}
+
+		rk.keys[id] = aead
+	}
+
+	return rk, nil
+}
+
+// Seal returns Whistler-Route value for rawurl sealed with key keyID, for Go
+// clients and tools. Zero now leaves blob without timestamp.
+func (rk *RouteKeys) Seal(keyID, rawurl string, now time.Time) (string, error) {
+	aead, ok := rk.keys[keyID]
+	if !ok {
+		return "", errUnknownRoute
+	}
+
+	rt := route{URL: rawurl}
+	if !now.IsZero() {
+		rt.TS = now.Unix()
+	}
+
+	plain, err := json.Marshal(rt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	blob := aead.Seal(nonce, nonce, plain, []byte(keyID))
+
+	return keyID + "." + base64.RawURLEncoding.EncodeToString(blob), nil
+}
+
+// Open decrypts Whistler-Route value and returns destination URL
+func (rk *RouteKeys) Open(value string) (string, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidRoute
+	}
+
+	aead, ok := rk.keys[parts[0]]
+	if !ok {
+		return "", errUnknownRoute
+	}
+
+	blob, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(blob) < aead.NonceSize() {
+		return "", errInvalidRoute
+	}
+
+	plain, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], []byte(parts[0]))
+	if err != nil {
+		return "", errInvalidRoute
+	}
+
+	rt := route{}
+	err = json.Unmarshal(plain, &rt)
+	if err != nil || len(rt.URL) == 0 {
+		return "", errInvalidRoute
+	}
+
+	if rt.TS != 0 {
+		if d := time.Since(time.Unix(rt.TS, 0)); d > rk.window || d < -rk.window {
+			return "", errRouteExpired
+		}
+	}
+
+	return rt.URL, nil
+}
+
+// FrontRule routes domain fronted requests. Client connects with innocent SNI
+// (front domain on shared CDN) and puts Host matching Host pattern inside TLS,
+// request is then forwarded to URL with request path appended. With SNI set,
+// rule only matches connections with that server name, which standalone
+// reflector terminating TLS itself can check.
+type FrontRule struct {
+	Host string `json:"host"`
+	SNI  string `json:"sni,omitempty"`
+	URL  string `json:"url"`
+}
+
+// validate checks front rule patterns and target
+func (f *FrontRule) validate() error {
+	if !validHostPattern(f.Host) || (len(f.SNI) > 0 && !validHostPattern(f.SNI)) {
+		return fmt.Errorf("invalid front host %q", f.Host)
+	}
+
+	u, err := url.Parse(f.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 || len(u.RawQuery) > 0 {
+		return fmt.Errorf("invalid front url %q", f.URL)
+	}
+
+	return nil
+}
+
+// frontURL returns URL fronted request r is routed to, empty when no rule matches
+func (h *Hosts) frontURL(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	sni := ""
+	if r.TLS != nil {
+		sni = strings.ToLower(r.TLS.ServerName)
+	}
+
+	for _, f := range h.current().Fronts {
+		if _, ok := matchHost(f.Host, host); !ok {
+			continue
+		}
+		if len(f.SNI) > 0 {
+			if _, ok := matchHost(f.SNI, sni); !ok {
+				continue
+			}
+		}
+
+		u, _ := url.Parse(f.URL)
+		u.Path = path.Join("/", u.Path, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		u.RawQuery = r.URL.RawQuery
+
+		return u.String()
+	}
+
+	return ""
+}
+
+// routeTarget is value client token is bound to, route blob or plaintext host
+// when sent, otherwise Host of fronted request
+func routeTarget(r *http.Request) string {
+	if target := r.Header.Get(routeHeader); len(target) > 0 {
+		return target
+	}
+	if target := r.Header.Get("Whistler-Host"); len(target) > 0 {
+		return target
+	}
+
+	return r.Host
+}
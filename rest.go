@@ -2,13 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"net/http"
 
-	"bytes"
-	"database/sql"
-	"net/url"
 	"path"
 	"time"
 
@@ -36,9 +32,9 @@ type Report struct {
 
 // Metadata submitted with MediaFile & Evidence
 type Metadata struct {
-	Cells              []string `json:"cells,omitempty" validate:"whistlercells"`
-	Wifis              []string `json:"wifis,omitempty"`
-	Timestamp          int64    `json:"timestamp,omitempty"`
+	Cells              []string `json:"cells,omitempty" valid:"whistlercellslist,optional"`
+	Wifis              []string `json:"wifis,omitempty" valid:"whistlerbssidlist,optional"`
+	Timestamp          int64    `json:"timestamp,omitempty" valid:"whistlertimestamp,optional"`
 	AmbientTemperature float64  `json:"ambientTemperature,omitempty"`
 	Light              float64  `json:"light,omitempty"`
 	Location           Location `json:"location,omitempty"`
@@ -67,10 +63,10 @@ type ReportResponse struct {
 
 // Location submitted in Metadata
 type Location struct {
-	Latitude  float64 `json:"latitude,omitempty"`
-	Longitude float64 `json:"longitude,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty" valid:"whistlerlatitude,optional"`
+	Longitude float64 `json:"longitude,omitempty" valid:"whistlerlongitude,optional"`
 	Altitude  float64 `json:"altitude,omitempty"`
-	Accuracy  float64 `json:"accuracy,omitempty"`
+	Accuracy  float64 `json:"accuracy,omitempty" valid:"whistleraccuracy,optional"`
 }
 
 // MediaFile acquired by client
@@ -89,47 +85,22 @@ type FormMediaFileRegister struct {
 	Attachments []MediaFile `json:"attachments,omitempty"`
 }
 
-// TrainModule object describing single train module
-type TrainModule struct {
-	ID           int64  `json:"id,omitempty"`
-	Name         string `json:"name,omitempty"`
-	URL          string `json:"url,omitempty"`
-	Organization string `json:"organization,omitempty"`
-	Type         string `json:"type,omitempty"`
-	Size         int64  `json:"size,omitempty"`
-}
-
 func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(500)
-		return
-	}
-
 	// decode report
 	report := &Report{
 		Public: true, // default
 	}
-	err = json.Unmarshal(body, report)
+	body, status, err := decodeJSONBody(w, r, Config.MaxReportBodyBytes, report)
 	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(400)
+		writeBodyError(w, status, err)
 		return
 	}
 
-	// validate Report struct with Evidences & Recipients
+	// validate Report struct with Evidences & Recipients, including Evidences[].Metadata
 	if !validateStruct(w, "Report", report) {
 		return
 	}
 
-	// validate Evidences[].Metadata (not required property)
-	for _, evidence := range report.Evidences {
-		if !validateMetadata(w, "Evidence.Metadata", evidence.Metadata) {
-			return
-		}
-	}
-
 	// set for approval only if public (0 - unreviewed, 1 - approved, 2 - rejected)
 	if !report.Public {
 		report.Status = 0
@@ -148,7 +119,7 @@ func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 	tx, err := DB.Begin()
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
@@ -160,14 +131,14 @@ func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		)`, report.UID, report.Created, report.Public, report.Status, report.JSON)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
 	reportID, err := result.LastInsertId()
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
@@ -177,7 +148,7 @@ func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		if err != nil && err != NotFound {
 			log.Println(err)
 			tx.Rollback()
-			w.WriteHeader(500)
+			writeError(w, 500, ErrCodeInternal, nil)
 			return
 		}
 
@@ -195,14 +166,14 @@ func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		if err != nil {
 			log.Println(err)
 			tx.Rollback()
-			w.WriteHeader(500)
+			writeError(w, 500, ErrCodeInternal, nil)
 			return
 		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
@@ -215,33 +186,19 @@ func handleCreateReport(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 }
 
 func handleRegisterFormMediaFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(500)
-		return
-	}
-
 	// decode report
 	registration := &FormMediaFileRegister{}
-	err = json.Unmarshal(body, registration)
+	_, status, err := decodeJSONBody(w, r, Config.MaxRegistrationBodyBytes, registration)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(400)
+		writeBodyError(w, status, err)
 		return
 	}
 
-	// validate FormMediaFileRegister struct with optional Metadata
+	// validate FormMediaFileRegister struct with MediaFiles and their optional Metadata
 	if !validateStruct(w, "FormMediaFileRegister", registration) {
 		return
 	}
 
-	// validate optional Metadata
-	for _, mediaFile := range registration.Attachments {
-		if !validateMediafile(w, "FormMediaFileRegister.MediaFile", mediaFile) {
-			return
-		}
-	}
-
 	// insert into database
 	for _, mediaFile := range registration.Attachments {
 		mediaFile.State = 10 // todo: REGISTERED
@@ -262,84 +219,10 @@ func handleRegisterFormMediaFiles(w http.ResponseWriter, r *http.Request, ps htt
 				updated = NOW()`, mediaFile.UID, mediaFile.FileName, mediaFile.FileExt, metadata, mediaFile.State, mediaFile.Created)
 		if err != nil {
 			log.Println(err)
-			w.WriteHeader(500)
-			return
-		}
-	}
-
-	w.WriteHeader(200)
-}
-
-func handleListModules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	ident := r.URL.Query().Get("ident")
-
-	var queryBuffer bytes.Buffer
-
-	queryBuffer.WriteString(`
-		SELECT 
-			train_module.id, train_module.name, train_module.path, train_organization.name, 
-			train_module.type, train_module.size
-		FROM
-			train_module LEFT JOIN train_organization ON train_module.organizationId = train_organization.id
-		WHERE
-	`)
-
-	if len(ident) > 0 {
-		queryBuffer.WriteString(`train_module.ident = ?`)
-	} else {
-		queryBuffer.WriteString(`train_module.private = 0`)
-	}
-
-	queryBuffer.WriteString(` ORDER BY train_module.id DESC`)
-
-	var err error
-	var rows *sql.Rows
-
-	if len(ident) > 0 {
-		rows, err = DB.Query(queryBuffer.String(), ident)
-	} else {
-		rows, err = DB.Query(queryBuffer.String())
-	}
-
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(500)
-		return
-	}
-	defer rows.Close()
-
-	modules := make([]TrainModule, 0)
-
-	for rows.Next() {
-		var module TrainModule
-		var moduleType sql.NullString
-
-		err := rows.Scan(&module.ID, &module.Name, &module.URL, &module.Organization, &moduleType, &module.Size)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(500)
+			writeError(w, 500, ErrCodeInternal, nil)
 			return
 		}
-
-		if moduleType.Valid {
-			module.Type = moduleType.String
-		}
-
-		url, err := url.Parse(Config.ModuleBaseURL)
-		url.Path = path.Join(url.Path, module.URL)
-		module.URL = url.String()
-
-		modules = append(modules, module)
 	}
 
-	err = rows.Err()
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(500)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(modules)
 }
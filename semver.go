@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rxSemver = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)` +
+	`(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`)
+
+// errInvalidVersion version is not semver
+var errInvalidVersion = errors.New("invalid semantic version")
+
+// semver is parsed semantic version, build metadata is dropped as it has no precedence
+type semver struct {
+	major, minor, patch int64
+	prerelease          []string
+}
+
+func parseSemver(version string) (*semver, error) {
+	m := rxSemver.FindStringSubmatch(version)
+	if m == nil {
+		return nil, errInvalidVersion
+	}
+
+	v := &semver{}
+	var err error
+
+	if v.major, err = strconv.ParseInt(m[1], 10, 64); err != nil {
+		return nil, errInvalidVersion
+	}
+	if v.minor, err = strconv.ParseInt(m[2], 10, 64); err != nil {
+		return nil, errInvalidVersion
+	}
+	if v.patch, err = strconv.ParseInt(m[3], 10, 64); err != nil {
+		return nil, errInvalidVersion
+	}
+	if len(m[4]) > 0 {
+		v.prerelease = strings.Split(m[4], ".")
+	}
+
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 if v is lower, equal or higher than o, following semver precedence
+func (v *semver) compare(o *semver) int {
+	if c := compareInt(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.patch, o.patch); c != 0 {
+		return c
+	}
+
+	// release is higher than any of its prereleases
+	if len(v.prerelease) == 0 || len(o.prerelease) == 0 {
+		return compareInt(int64(len(o.prerelease)), int64(len(v.prerelease)))
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := comparePrerelease(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareInt(int64(len(v.prerelease)), int64(len(o.prerelease)))
+}
+
+// comparePrerelease compares single prerelease identifiers, numeric ones are lower than alphanumeric
+func comparePrerelease(a string, b string) int {
+	an, aerr := strconv.ParseInt(a, 10, 64)
+	bn, berr := strconv.ParseInt(b, 10, 64)
+
+	switch {
+	case aerr == nil && berr == nil:
+		return compareInt(an, bn)
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+func compareInt(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxInstalledModules is most modules client can ask updates for at once
+	maxInstalledModules = 500
+	// defaultModulePage is page size when client paginates without limit
+	defaultModulePage = 50
+	// maxModulePage is largest page client can ask for
+	maxModulePage = 200
+	// maxModuleSearch is longest free text search
+	maxModuleSearch = 100
+)
+
+// errTooManyModules client asked for updates of too many modules
+var errTooManyModules = errors.New("too many modules")
+
+// TrainModule object describing single train module
+type TrainModule struct {
+	ID           int64  `json:"id,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Description  string `json:"description,omitempty"`
+	Language     string `json:"language,omitempty"`
+	URL          string `json:"url,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Type         string `json:"type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Version      string `json:"version,omitempty"`
+	SHA256       string `json:"sha256,omitempty"`
+	ReleaseNotes string `json:"releaseNotes,omitempty"`
+}
+
+// moduleFilter selects published modules visible to client
+type moduleFilter struct {
+	ident        string   // legacy, only modules with this ident are listed
+	unlocked     []int64  // private modules unlocked by invite tokens, listed too
+	tokens       []string // invite tokens of request, added to URLs of modules they unlock
+	ids          []int64  // only modules with these ids
+	languages    []string // translate to first of these languages module has
+	organization string   // only modules of organization with this name
+	moduleType   string   // only modules of this type
+	language     string   // only modules available in this language
+	search       string   // free text in name or description, any language
+	cursor       int64    // only modules with id lower than this
+	limit        int      // at most this many modules, 0 is no limit
+	baseURL      string   // absolute base of module URLs, depends on request origin
+}
+
+// key returns filter as string usable as cache key. Cached bodies carry tokens in
+// module URLs, so token hashes are part of key and clients never get others' tokens.
+func (f *moduleFilter) key() string {
+	unlocked := make([]string, 0, len(f.unlocked))
+	for _, id := range f.unlocked {
+		unlocked = append(unlocked, strconv.FormatInt(id, 10))
+	}
+
+	tokens := make([]string, 0, len(f.tokens))
+	for _, token := range f.tokens {
+		tokens = append(tokens, hashUnlockToken(token))
+	}
+
+	return strings.Join([]string{
+		f.ident, strings.Join(unlocked, ","), strings.Join(tokens, ","), strings.Join(f.languages, ","), f.organization,
+		f.moduleType, f.language, f.search, strconv.FormatInt(f.cursor, 10), strconv.Itoa(f.limit), f.baseURL,
+	}, "\x00")
+}
+
+// credentials returns query parameters client needs to download private module,
+// ident it was listed by or invite tokens when it was unlocked
+func (f *moduleFilter) credentials(id int64, ident string) url.Values {
+	values := make(url.Values)
+
+	if len(f.ident) > 0 && ident == f.ident {
+		values.Set("ident", f.ident)
+	}
+
+	for _, unlocked := range f.unlocked {
+		if unlocked == id && len(f.tokens) > 0 {
+			values.Set("unlock", strings.Join(f.tokens, ","))
+			break
+		}
+	}
+
+	return values
+}
+
+// parseModuleFilter reads list filter from query parameters, it returns field errors
+// if parameters are not valid
+func parseModuleFilter(r *http.Request) (*moduleFilter, map[string]string) {
+	query := r.URL.Query()
+	fields := make(map[string]string)
+
+	filter := &moduleFilter{
+		ident:        query.Get("ident"),
+		languages:    requestLanguages(query.Get("lang"), r.Header.Get("Accept-Language")),
+		organization: query.Get("organization"),
+		moduleType:   query.Get("type"),
+		search:       strings.TrimSpace(query.Get("q")),
+	}
+
+	if language := query.Get("language"); len(language) > 0 {
+		filter.language = normalizeLanguage(language)
+		if len(filter.language) == 0 {
+			fields["language"] = "not a language tag"
+		}
+	}
+
+	if len(filter.search) > maxModuleSearch {
+		fields["q"] = "search too long"
+	}
+
+	// pagination is opt-in, older clients expect whole catalog
+	if cursor := query.Get("cursor"); len(cursor) > 0 {
+		var err error
+		filter.cursor, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || filter.cursor <= 0 {
+			fields["cursor"] = "invalid cursor"
+		}
+		filter.limit = defaultModulePage
+	}
+
+	if limit := query.Get("limit"); len(limit) > 0 {
+		var err error
+		filter.limit, err = strconv.Atoi(limit)
+		if err != nil || filter.limit < 1 || filter.limit > maxModulePage {
+			fields["limit"] = "limit must be between 1 and " + strconv.Itoa(maxModulePage)
+		}
+	}
+
+	if len(fields) > 0 {
+		return nil, fields
+	}
+
+	return filter, nil
+}
+
+// likePattern escapes s for use in LIKE as substring match
+func likePattern(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `%`, `\%`, -1)
+	s = strings.Replace(s, `_`, `\_`, -1)
+
+	return "%" + s + "%"
+}
+
+// moduleTranslation is module name and description in one language
+type moduleTranslation struct {
+	name        string
+	description string
+}
+
+// inPlaceholders returns "(?, ?, ...)" for n values
+func inPlaceholders(n int) string {
+	return `(?` + strings.Repeat(`, ?`, n-1) + `)`
+}
+
+// translateModules replaces module name and description with best translation
+// for languages, modules without matching translation stay in their own language
+func translateModules(modules []TrainModule, languages []string) error {
+	if len(modules) == 0 || len(languages) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(modules)+len(languages))
+	for _, module := range modules {
+		args = append(args, module.ID)
+	}
+	for _, language := range languages {
+		args = append(args, language)
+	}
+
+	rows, err := DB.Query(`
+		SELECT
+			moduleId, lang, name, description
+		FROM
+			train_module_translation
+		WHERE
+			moduleId IN `+inPlaceholders(len(modules))+` AND lang IN `+inPlaceholders(len(languages)), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	translations := make(map[int64]map[string]moduleTranslation)
+
+	for rows.Next() {
+		var moduleID int64
+		var lang string
+		var translation moduleTranslation
+		var description sql.NullString
+
+		err = rows.Scan(&moduleID, &lang, &translation.name, &description)
+		if err != nil {
+			return err
+		}
+		translation.description = description.String
+
+		if translations[moduleID] == nil {
+			translations[moduleID] = make(map[string]moduleTranslation)
+		}
+		translations[moduleID][lang] = translation
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for i := range modules {
+		module := &modules[i]
+
+		for _, language := range languages {
+			// module own language is as good as translation
+			if language == module.Language {
+				break
+			}
+
+			if translation, ok := translations[module.ID][language]; ok {
+				module.Name = translation.name
+				module.Description = translation.description
+				module.Language = language
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// queryModules returns modules matching filter
+func queryModules(filter *moduleFilter) ([]TrainModule, error) {
+	var queryBuffer bytes.Buffer
+	args := make([]interface{}, 0)
+
+	queryBuffer.WriteString(`
+		SELECT 
+			train_module.id, train_module.name, train_module.path, train_organization.name, 
+			train_module.type, train_module.size, train_module.version, train_module.packageHash,
+			train_module.releaseNotes, train_module.description, train_module.language,
+			train_module.private, train_module.ident
+		FROM
+			train_module LEFT JOIN train_organization ON train_module.organizationId = train_organization.id
+		WHERE
+			train_module.published = 1 AND
+	`)
+
+	if len(filter.ident) > 0 {
+		queryBuffer.WriteString(`(train_module.ident = ?`)
+		args = append(args, filter.ident)
+	} else {
+		queryBuffer.WriteString(`(train_module.private = 0`)
+	}
+	if len(filter.unlocked) > 0 {
+		queryBuffer.WriteString(` OR train_module.id IN ` + inPlaceholders(len(filter.unlocked)))
+		args = append(args, int64Args(filter.unlocked)...)
+	}
+	queryBuffer.WriteString(`)`)
+
+	if len(filter.ids) > 0 {
+		queryBuffer.WriteString(` AND train_module.id IN ` + inPlaceholders(len(filter.ids)))
+		args = append(args, int64Args(filter.ids)...)
+	}
+
+	if len(filter.organization) > 0 {
+		queryBuffer.WriteString(` AND train_organization.name = ?`)
+		args = append(args, filter.organization)
+	}
+
+	if len(filter.moduleType) > 0 {
+		queryBuffer.WriteString(` AND train_module.type = ?`)
+		args = append(args, filter.moduleType)
+	}
+
+	if len(filter.language) > 0 {
+		queryBuffer.WriteString(` AND (train_module.language = ? OR EXISTS (
+			SELECT 1 FROM train_module_translation
+			WHERE train_module_translation.moduleId = train_module.id AND train_module_translation.lang = ?))`)
+		args = append(args, filter.language, filter.language)
+	}
+
+	if len(filter.search) > 0 {
+		pattern := likePattern(filter.search)
+		queryBuffer.WriteString(` AND (train_module.name LIKE ? OR train_module.description LIKE ? OR EXISTS (
+			SELECT 1 FROM train_module_translation
+			WHERE train_module_translation.moduleId = train_module.id AND
+				(train_module_translation.name LIKE ? OR train_module_translation.description LIKE ?)))`)
+		args = append(args, pattern, pattern, pattern, pattern)
+	}
+
+	if filter.cursor > 0 {
+		queryBuffer.WriteString(` AND train_module.id < ?`)
+		args = append(args, filter.cursor)
+	}
+
+	queryBuffer.WriteString(` ORDER BY train_module.id DESC`)
+
+	if filter.limit > 0 {
+		queryBuffer.WriteString(` LIMIT ?`)
+		args = append(args, filter.limit)
+	}
+
+	rows, err := DB.Query(queryBuffer.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	baseURL, err := url.Parse(filter.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := make([]TrainModule, 0)
+
+	for rows.Next() {
+		var module TrainModule
+		var moduleType, version, packageHash, releaseNotes, description, language, ident sql.NullString
+		var private bool
+
+		err := rows.Scan(&module.ID, &module.Name, &module.URL, &module.Organization, &moduleType, &module.Size,
+			&version, &packageHash, &releaseNotes, &description, &language, &private, &ident)
+		if err != nil {
+			return nil, err
+		}
+
+		if moduleType.Valid {
+			module.Type = moduleType.String
+		}
+		module.Version = version.String
+		module.SHA256 = packageHash.String
+		module.ReleaseNotes = releaseNotes.String
+		module.Description = description.String
+		module.Language = language.String
+
+		url := *baseURL
+		url.Path = path.Join(url.Path, module.URL)
+		if private {
+			url.RawQuery = filter.credentials(module.ID, ident.String).Encode()
+		}
+		module.URL = url.String()
+
+		modules = append(modules, module)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = translateModules(modules, filter.languages)
+	if err != nil {
+		return nil, err
+	}
+
+	return modules, nil
+}
+
+func handleListModules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filter, fields := parseModuleFilter(r)
+	if fields != nil {
+		writeError(w, 400, ErrCodeValidation, fields)
+		return
+	}
+
+	var err error
+	filter.unlocked, err = unlockedModules(r)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if len(filter.unlocked) > 0 {
+		filter.tokens = requestUnlockTokens(r)
+	}
+
+	filter.baseURL, err = moduleBaseURL(r)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept-Language")
+
+	serveModulesCached(w, r, "list:"+filter.key(), func() (interface{}, int64, error) {
+		// one more than asked, so we know if there is next page
+		page := *filter
+		if page.limit > 0 {
+			page.limit++
+		}
+
+		modules, err := queryModules(&page)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var next int64
+
+		if filter.limit > 0 && len(modules) > filter.limit {
+			modules = modules[:filter.limit]
+			next = modules[len(modules)-1].ID
+		}
+
+		return modules, next, nil
+	})
+}
+
+// parseInstalled parses "id:version,id:version" list of modules client has
+func parseInstalled(installed string) (map[int64]*semver, error) {
+	versions := make(map[int64]*semver)
+
+	for _, item := range strings.Split(installed, ",") {
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, errInvalidVersion
+		}
+
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		version, err := parseSemver(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		versions[id] = version
+	}
+
+	if len(versions) > maxInstalledModules {
+		return nil, errTooManyModules
+	}
+
+	return versions, nil
+}
+
+// handleModuleUpdates returns modules from installed list that have newer version
+func handleModuleUpdates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	installed, err := parseInstalled(r.URL.Query().Get("installed"))
+	if err != nil {
+		writeError(w, 400, ErrCodeValidation, map[string]string{"installed": err.Error()})
+		return
+	}
+
+	updates := make([]TrainModule, 0)
+
+	if len(installed) > 0 {
+		filter := &moduleFilter{
+			ident:     r.URL.Query().Get("ident"),
+			ids:       make([]int64, 0, len(installed)),
+			languages: requestLanguages(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language")),
+		}
+		for id := range installed {
+			filter.ids = append(filter.ids, id)
+		}
+
+		filter.unlocked, err = unlockedModules(r)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if len(filter.unlocked) > 0 {
+			filter.tokens = requestUnlockTokens(r)
+		}
+
+		filter.baseURL, err = moduleBaseURL(r)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		modules, err := queryModules(filter)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		for _, module := range modules {
+			version, err := parseSemver(module.Version)
+			if err != nil {
+				continue // not versioned
+			}
+
+			if version.compare(installed[module.ID]) > 0 {
+				updates = append(updates, module)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updates)
+}
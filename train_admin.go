@@ -0,0 +1,659 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TrainOrganization publishing train modules
+type TrainOrganization struct {
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name" valid:"required,length(1|255)"`
+}
+
+// AdminTrainModule is train module as managed by admins
+type AdminTrainModule struct {
+	ID             int64  `json:"id,omitempty"`
+	Name           string `json:"name" valid:"required,length(1|255)"`
+	Description    string `json:"description,omitempty" valid:"length(0|4096)"`
+	Language       string `json:"language,omitempty" valid:"whistlerlang,optional"`
+	Path           string `json:"path" valid:"required,length(1|1024)"`
+	OrganizationID int64  `json:"organizationId" valid:"required"`
+	Type           string `json:"type,omitempty" valid:"length(0|64)"`
+	Size           int64  `json:"size,omitempty"`
+	Private        bool   `json:"private"`
+	Ident          string `json:"ident,omitempty" valid:"length(0|64)"`
+	Published      bool   `json:"published"`
+	PackageHash    string `json:"packageHash,omitempty"` // set by package upload only
+	Version        string `json:"version,omitempty"`     // set by package upload only
+}
+
+// validateAdminTrainModule checks module struct and that private modules are reachable by ident
+func validateAdminTrainModule(w http.ResponseWriter, module *AdminTrainModule) bool {
+	if !validateStruct(w, "AdminTrainModule", module) {
+		return false
+	}
+
+	if module.Private && len(module.Ident) == 0 {
+		writeError(w, 400, ErrCodeValidation, map[string]string{
+			"ident": "private module needs ident",
+		})
+		return false
+	}
+
+	if module.Size < 0 {
+		writeError(w, 400, ErrCodeValidation, map[string]string{
+			"size": "size can not be negative",
+		})
+		return false
+	}
+
+	return true
+}
+
+// organizationExists checks organization with id is there
+func organizationExists(id int64) (bool, error) {
+	var count int64
+
+	err := DB.QueryRow(`SELECT COUNT(*) FROM train_organization WHERE id = ?`, id).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// getAdminTrainModule gets module by id with all admin managed fields
+func getAdminTrainModule(id int64) (*AdminTrainModule, error) {
+	var module AdminTrainModule
+	var description, language, moduleType, ident, packageHash, version sql.NullString
+
+	row := DB.QueryRow(`
+		SELECT
+			id, name, description, language, path, organizationId, type, size, private, ident, published,
+			packageHash, version
+		FROM
+			train_module
+		WHERE
+			id = ?`, id)
+	err := row.Scan(&module.ID, &module.Name, &description, &language, &module.Path, &module.OrganizationID,
+		&moduleType, &module.Size, &module.Private, &ident, &module.Published, &packageHash, &version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NotFound
+		}
+		return nil, err
+	}
+
+	module.Description = description.String
+	module.Language = language.String
+	module.Type = moduleType.String
+	module.Ident = ident.String
+	module.PackageHash = packageHash.String
+	module.Version = version.String
+
+	return &module, nil
+}
+
+// nullString converts empty string to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: len(s) > 0}
+}
+
+func handleAdminListOrganizations(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rows, err := DB.Query(`SELECT id, name FROM train_organization ORDER BY id`)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	organizations := make([]TrainOrganization, 0)
+
+	for rows.Next() {
+		var organization TrainOrganization
+
+		err = rows.Scan(&organization.ID, &organization.Name)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		organizations = append(organizations, organization)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(organizations)
+}
+
+func handleAdminCreateOrganization(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	organization := &TrainOrganization{}
+	_, status, err := decodeJSONBody(w, r, Config.MaxAdminBodyBytes, organization)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+
+	if !validateStruct(w, "TrainOrganization", organization) {
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO train_organization (name) VALUES (?)`, organization.Name)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	organization.ID, err = result.LastInsertId()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "create", "train_organization", organization.ID, organization)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(organization)
+}
+
+func handleAdminUpdateOrganization(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	organization := &TrainOrganization{}
+	_, status, err := decodeJSONBody(w, r, Config.MaxAdminBodyBytes, organization)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+	organization.ID = id
+
+	if !validateStruct(w, "TrainOrganization", organization) {
+		return
+	}
+
+	exists, err := organizationExists(id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE train_organization SET name = ? WHERE id = ?`, organization.Name, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "update", "train_organization", id, organization)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(organization)
+}
+
+func handleAdminDeleteOrganization(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// organization with modules can not go
+	var modules int64
+	err = tx.QueryRow(`SELECT COUNT(*) FROM train_module WHERE organizationId = ?`, id).Scan(&modules)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if modules > 0 {
+		writeError(w, 409, ErrCodeConflict, nil)
+		return
+	}
+
+	result, err := tx.Exec(`DELETE FROM train_organization WHERE id = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if ra == 0 {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	err = audit(tx, r, "delete", "train_organization", id, nil)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAdminListModules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rows, err := DB.Query(`
+		SELECT
+			id, name, description, language, path, organizationId, type, size, private, ident, published,
+			packageHash, version
+		FROM
+			train_module
+		ORDER BY id DESC`)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	modules := make([]AdminTrainModule, 0)
+
+	for rows.Next() {
+		var module AdminTrainModule
+		var description, language, moduleType, ident, packageHash, version sql.NullString
+
+		err = rows.Scan(&module.ID, &module.Name, &description, &language, &module.Path, &module.OrganizationID,
+			&moduleType, &module.Size, &module.Private, &ident, &module.Published, &packageHash, &version)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		module.Description = description.String
+		module.Language = language.String
+		module.Type = moduleType.String
+		module.Ident = ident.String
+		module.PackageHash = packageHash.String
+		module.Version = version.String
+
+		modules = append(modules, module)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modules)
+}
+
+func handleAdminGetModule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	module, err := getAdminTrainModule(id)
+	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(module)
+}
+
+func handleAdminCreateModule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	module := &AdminTrainModule{}
+	_, status, err := decodeJSONBody(w, r, Config.MaxAdminBodyBytes, module)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+
+	if !validateAdminTrainModule(w, module) {
+		return
+	}
+
+	exists, err := organizationExists(module.OrganizationID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, 400, ErrCodeValidation, map[string]string{
+			"organizationId": "organization does not exist",
+		})
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO train_module (
+			name, description, language, path, organizationId, type, size, private, ident, published
+		) VALUES (
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		)`, module.Name, nullString(module.Description), nullString(module.Language), module.Path, module.OrganizationID, nullString(module.Type), module.Size,
+		module.Private, nullString(module.Ident), module.Published)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	module.ID, err = result.LastInsertId()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "create", "train_module", module.ID, module)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(module)
+}
+
+func handleAdminUpdateModule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	_, err := getAdminTrainModule(id)
+	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	module := &AdminTrainModule{}
+	_, status, err := decodeJSONBody(w, r, Config.MaxAdminBodyBytes, module)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+	module.ID = id
+
+	if !validateAdminTrainModule(w, module) {
+		return
+	}
+
+	exists, err := organizationExists(module.OrganizationID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, 400, ErrCodeValidation, map[string]string{
+			"organizationId": "organization does not exist",
+		})
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE train_module SET
+			name = ?, description = ?, language = ?, path = ?, organizationId = ?, type = ?, size = ?,
+			private = ?, ident = ?, published = ?
+		WHERE
+			id = ?`, module.Name, nullString(module.Description), nullString(module.Language), module.Path, module.OrganizationID, nullString(module.Type), module.Size,
+		module.Private, nullString(module.Ident), module.Published, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "update", "train_module", id, module)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(module)
+}
+
+// setModulePublished returns handler publishing or unpublishing module
+func setModulePublished(published bool) httprouter.Handle {
+	action := "unpublish"
+	if published {
+		action = "publish"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, ok := paramID(ps)
+		if !ok {
+			writeError(w, 400, ErrCodeBadRequest, nil)
+			return
+		}
+
+		tx, err := DB.Begin()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		defer tx.Rollback()
+
+		var count int64
+		err = tx.QueryRow(`SELECT COUNT(*) FROM train_module WHERE id = ? FOR UPDATE`, id).Scan(&count)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if count == 0 {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE train_module SET published = ? WHERE id = ?`, published, id)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		err = audit(tx, r, action, "train_module", id, nil)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		invalidateModuleCache()
+
+		log.Printf("Train module %d %sed\n", id, action)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleAdminDeleteModule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	module, err := getAdminTrainModule(id)
+	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM train_module WHERE id = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if ra == 0 {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	// package history goes with module
+	hashes, err := moduleVersionHashes(tx, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM train_module_version WHERE moduleId = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM train_module_translation WHERE moduleId = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	// invites keep unlocking their other modules
+	_, err = tx.Exec(`DELETE FROM train_invite_module WHERE moduleId = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "delete", "train_module", id, nil)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	if len(module.PackageHash) > 0 {
+		hashes = append(hashes, module.PackageHash)
+	}
+
+	releaseBlobs(hashes...)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// inviteCodeAlphabet has no look-alike characters, codes are typed by hand
+	inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// inviteCodeLength is number of characters in generated invite code
+	inviteCodeLength = 10
+	// unlockTokenLength is number of characters in unlock token issued on redemption
+	unlockTokenLength = 32
+	// maxUnlockTokens is most unlock tokens client can present at once
+	maxUnlockTokens = 20
+	// maxRedeemBodyBytes is largest invite redemption request body accepted
+	maxRedeemBodyBytes = 1 << 10
+)
+
+// TrainInvite grants access to set of private modules
+type TrainInvite struct {
+	ID             int64   `json:"id,omitempty"`
+	Code           string  `json:"code,omitempty"`
+	OrganizationID int64   `json:"organizationId" valid:"required"`
+	ModuleIDs      []int64 `json:"moduleIds" valid:"required"`
+	Expires        int64   `json:"expires,omitempty"` // unix time, 0 never expires
+	MaxUses        int64   `json:"maxUses,omitempty"` // redemptions, 0 is unlimited
+	Uses           int64   `json:"uses"`
+	Revoked        bool    `json:"revoked"`
+	Created        int64   `json:"created,omitempty"`
+}
+
+// newInviteCode generates random invite code
+func newInviteCode() (string, error) {
+	return randomCode(inviteCodeLength)
+}
+
+// randomCode generates random code of given length from inviteCodeAlphabet
+func randomCode(length int) (string, error) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = inviteCodeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// normalizeInviteCode uppercases code and drops separators people type
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+
+	return code
+}
+
+// InviteRedemption is answer to invite code redemption. Token is issued by server
+// and presented in unlock query parameter of catalog and package requests.
+type InviteRedemption struct {
+	Token     string  `json:"token"`
+	ModuleIDs []int64 `json:"moduleIds"`
+	Expires   int64   `json:"expires,omitempty"` // unix time, 0 never expires
+}
+
+// hashUnlockToken returns hex SHA-256 of token, only hashes are stored
+func hashUnlockToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestUnlockTokens returns tokens from repeated or comma separated unlock query parameter
+func requestUnlockTokens(r *http.Request) []string {
+	seen := make(map[string]bool)
+	tokens := make([]string, 0)
+
+	for _, value := range r.URL.Query()["unlock"] {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if len(token) == 0 || len(token) > 64 || seen[token] || len(tokens) >= maxUnlockTokens {
+				continue
+			}
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
+
+// redeemInviteCode counts one use of invite with code and issues unlock token for it.
+// Invalid, expired, revoked or used up codes return nil.
+func redeemInviteCode(code string) (*InviteRedemption, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var inviteID, expires, maxUses, uses int64
+
+	row := tx.QueryRow(`
+		SELECT
+			id, expires, maxUses, uses
+		FROM
+			train_invite
+		WHERE
+			code = ? AND revoked = 0
+		FOR UPDATE`, code)
+	err = row.Scan(&inviteID, &expires, &maxUses, &uses)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	now := time.Now().UTC().Unix()
+
+	if (expires > 0 && expires < now) || (maxUses > 0 && uses >= maxUses) {
+		return nil, nil
+	}
+
+	token, err := randomCode(unlockTokenLength)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO train_invite_use (inviteId, tokenHash, created) VALUES (?, ?, ?)`,
+		inviteID, hashUnlockToken(token), now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE train_invite SET uses = uses + 1 WHERE id = ?`, inviteID)
+	if err != nil {
+		return nil, err
+	}
+
+	moduleIDs, err := inviteModules(tx, inviteID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InviteRedemption{Token: token, ModuleIDs: moduleIDs, Expires: expires}, tx.Commit()
+}
+
+// inviteModules returns ids of modules invite grants access to
+func inviteModules(tx *sql.Tx, inviteID int64) ([]int64, error) {
+	rows, err := tx.Query(`SELECT moduleId FROM train_invite_module WHERE inviteId = ? ORDER BY moduleId`, inviteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	moduleIDs := make([]int64, 0)
+
+	for rows.Next() {
+		var moduleID int64
+
+		err = rows.Scan(&moduleID)
+		if err != nil {
+			return nil, err
+		}
+
+		moduleIDs = append(moduleIDs, moduleID)
+	}
+
+	return moduleIDs, rows.Err()
+}
+
+// unlockedModules returns sorted ids of modules unlocked by tokens client presented.
+// Tokens of revoked or expired invites unlock nothing. It only reads, uses are
+// counted when code is redeemed.
+func unlockedModules(r *http.Request) ([]int64, error) {
+	tokens := requestUnlockTokens(r)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, 0, len(tokens)+1)
+	for _, token := range tokens {
+		args = append(args, hashUnlockToken(token))
+	}
+	args = append(args, time.Now().UTC().Unix())
+
+	rows, err := DB.Query(`
+		SELECT DISTINCT
+			train_invite_module.moduleId
+		FROM
+			train_invite_use
+			JOIN train_invite ON train_invite_use.inviteId = train_invite.id
+			JOIN train_invite_module ON train_invite.id = train_invite_module.inviteId
+		WHERE
+			train_invite_use.tokenHash IN `+inPlaceholders(len(tokens))+` AND
+			train_invite.revoked = 0 AND
+			(train_invite.expires = 0 OR train_invite.expires >= ?)
+		ORDER BY train_invite_module.moduleId`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unlocked := make([]int64, 0)
+
+	for rows.Next() {
+		var moduleID int64
+
+		err = rows.Scan(&moduleID)
+		if err != nil {
+			return nil, err
+		}
+
+		unlocked = append(unlocked, moduleID)
+	}
+
+	return unlocked, rows.Err()
+}
+
+func handleRedeemInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	_, status, err := decodeJSONBody(w, r, maxRedeemBodyBytes, &request)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+
+	code := normalizeInviteCode(request.Code)
+	if len(code) == 0 || len(code) > 64 {
+		writeError(w, 400, ErrCodeValidation, map[string]string{"code": "not valid invite code"})
+		return
+	}
+
+	redemption, err := redeemInviteCode(code)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if redemption == nil {
+		logNetPrintf(r, "Invite code %s not valid\n", code)
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(redemption)
+}
+
+func handleAdminListInvites(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rows, err := DB.Query(`
+		SELECT
+			train_invite.id, train_invite.code, train_invite.organizationId, train_invite.expires,
+			train_invite.maxUses, train_invite.uses, train_invite.revoked, train_invite.created,
+			train_invite_module.moduleId
+		FROM
+			train_invite LEFT JOIN train_invite_module ON train_invite.id = train_invite_module.inviteId
+		ORDER BY train_invite.id DESC, train_invite_module.moduleId`)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	invites := make([]*TrainInvite, 0)
+
+	for rows.Next() {
+		var invite TrainInvite
+		var moduleID sql.NullInt64
+
+		err = rows.Scan(&invite.ID, &invite.Code, &invite.OrganizationID, &invite.Expires,
+			&invite.MaxUses, &invite.Uses, &invite.Revoked, &invite.Created, &moduleID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		// one row per invite module
+		if len(invites) == 0 || invites[len(invites)-1].ID != invite.ID {
+			invite.ModuleIDs = make([]int64, 0)
+			invites = append(invites, &invite)
+		}
+
+		if moduleID.Valid {
+			last := invites[len(invites)-1]
+			last.ModuleIDs = append(last.ModuleIDs, moduleID.Int64)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func handleAdminCreateInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	invite := &TrainInvite{}
+	_, status, err := decodeJSONBody(w, r, Config.MaxAdminBodyBytes, invite)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+
+	if !validateStruct(w, "TrainInvite", invite) {
+		return
+	}
+
+	now := time.Now().UTC().Unix()
+
+	if invite.Expires != 0 && invite.Expires <= now {
+		writeError(w, 400, ErrCodeValidation, map[string]string{"expires": "must be in future"})
+		return
+	}
+
+	if invite.MaxUses < 0 {
+		writeError(w, 400, ErrCodeValidation, map[string]string{"maxUses": "can not be negative"})
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// invites only grant private modules of their organization
+	var count int64
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM train_module
+		WHERE organizationId = ? AND private = 1 AND id IN `+inPlaceholders(len(invite.ModuleIDs)),
+		append([]interface{}{invite.OrganizationID}, int64Args(invite.ModuleIDs)...)...).Scan(&count)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if count != int64(len(uniqueInt64(invite.ModuleIDs))) {
+		writeError(w, 400, ErrCodeValidation, map[string]string{
+			"moduleIds": "modules must be private modules of the organization",
+		})
+		return
+	}
+
+	invite.Code, err = newInviteCode()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invite.Uses = 0
+	invite.Revoked = false
+	invite.Created = now
+	invite.ModuleIDs = uniqueInt64(invite.ModuleIDs)
+
+	result, err := tx.Exec(`
+		INSERT INTO train_invite (
+			code, organizationId, expires, maxUses, uses, revoked, created
+		) VALUES (
+			?, ?, ?, ?, 0, 0, ?
+		)`, invite.Code, invite.OrganizationID, invite.Expires, invite.MaxUses, invite.Created)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	invite.ID, err = result.LastInsertId()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	for _, moduleID := range invite.ModuleIDs {
+		_, err = tx.Exec(`INSERT INTO train_invite_module (inviteId, moduleId) VALUES (?, ?)`, invite.ID, moduleID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+	}
+
+	err = audit(tx, r, "create", "train_invite", invite.ID, invite)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	log.Printf("Train invite %d created for %d modules\n", invite.ID, len(invite.ModuleIDs))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+func handleAdminRevokeInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE train_invite SET revoked = 1 WHERE id = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if ra == 0 {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	err = audit(tx, r, "revoke", "train_invite", id, nil)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uniqueInt64 returns values without duplicates, keeping order
+func uniqueInt64(values []int64) []int64 {
+	seen := make(map[int64]bool)
+	unique := make([]int64, 0, len(values))
+
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+
+	return unique
+}
+
+// int64Args converts values to query arguments
+func int64Args(values []int64) []interface{} {
+	args := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		args = append(args, v)
+	}
+
+	return args
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// tmpDir is directory under Config.BaseDir for uploads not yet in blob storage
+const tmpDir = "tmp"
+
+// packageExt extension of train module package path
+const packageExt = ".zip"
+
+// maxReleaseNotes is longest release notes text accepted
+const maxReleaseNotes = 4096
+
+// ModulePackage describes uploaded train module package version
+type ModulePackage struct {
+	ModuleID     int64  `json:"moduleId"`
+	Version      string `json:"version"`
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	ReleaseNotes string `json:"releaseNotes,omitempty"`
+}
+
+// receivePackage stores request body into temp file, making sure it is a ZIP
+func receivePackage(w http.ResponseWriter, r *http.Request) (string, int, error) {
+	dir := path.Join(Config.BaseDir, tmpDir)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", 500, err
+	}
+
+	out, err := ioutil.TempFile(dir, "package-")
+	if err != nil {
+		return "", 500, err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, http.MaxBytesReader(w, r.Body, Config.MaxModulePackageBytes))
+	if err != nil {
+		os.Remove(out.Name())
+		return "", bodyErrorStatus(err), err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 500, err
+	}
+
+	zr, err := zip.OpenReader(out.Name())
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 400, err
+	}
+	zr.Close()
+
+	return out.Name(), 200, nil
+}
+
+func handleAdminUploadPackage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	module, err := getAdminTrainModule(id)
+	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	// new package must have higher version than current one
+	version := r.URL.Query().Get("version")
+	releaseNotes := r.URL.Query().Get("releaseNotes")
+
+	newVersion, err := parseSemver(version)
+	if err != nil {
+		writeError(w, 400, ErrCodeValidation, map[string]string{"version": err.Error()})
+		return
+	}
+
+	if len(releaseNotes) > maxReleaseNotes {
+		writeError(w, 400, ErrCodeValidation, map[string]string{"releaseNotes": "release notes too long"})
+		return
+	}
+
+	if currentVersion, err := parseSemver(module.Version); err == nil && newVersion.compare(currentVersion) <= 0 {
+		writeError(w, 409, ErrCodeConflict, map[string]string{"version": "must be higher than " + module.Version})
+		return
+	}
+
+	tmp, status, err := receivePackage(w, r)
+	if err != nil {
+		log.Println(err)
+		switch status {
+		case 400:
+			writeError(w, 400, ErrCodeBadRequest, map[string]string{"package": "not a ZIP file"})
+		case 413:
+			writeError(w, 413, ErrCodeBodyTooLarge, nil)
+		default:
+			writeError(w, 500, ErrCodeInternal, nil)
+		}
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		os.Remove(tmp)
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	hash, size, err := importBlob(tx, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		writeInternalError(w, err)
+		return
+	}
+
+	// blob file is orphaned when upload is not committed, rollback must come first
+	// so releaseBlob does not wait for our lock
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+			releaseBlobs(hash)
+		}
+	}()
+
+	pkg := &ModulePackage{
+		ModuleID:     id,
+		Version:      version,
+		Path:         hash + packageExt,
+		Size:         size,
+		SHA256:       hash,
+		ReleaseNotes: releaseNotes,
+	}
+
+	_, err = tx.Exec(`
+		UPDATE train_module SET
+			path = ?, size = ?, packageHash = ?, version = ?, releaseNotes = ?
+		WHERE
+			id = ?`, pkg.Path, pkg.Size, pkg.SHA256, pkg.Version, nullString(pkg.ReleaseNotes), id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO train_module_version (
+			moduleId, version, packageHash, size, releaseNotes, created
+		) VALUES (
+			?, ?, ?, ?, ?, ?
+		)`, id, pkg.Version, pkg.SHA256, pkg.Size, nullString(pkg.ReleaseNotes), time.Now().UTC().Unix())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "upload_package", "train_module", id, pkg)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	committed = true
+	invalidateModuleCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pkg)
+}
+
+// packageAllowed checks package with hash belongs to published module client can
+// see, public one, private one with ident from query or one unlocked by invite
+// token from query. It returns if package is public and its creation time.
+func packageAllowed(r *http.Request, hash string) (bool, bool, int64, error) {
+	rows, err := DB.Query(`
+		SELECT
+			train_module.id, train_module.private, train_module.ident, file_blob.created
+		FROM
+			train_module JOIN file_blob ON train_module.packageHash = file_blob.hash
+		WHERE
+			train_module.packageHash = ? AND train_module.published = 1`, hash)
+	if err != nil {
+		return false, false, 0, err
+	}
+	defer rows.Close()
+
+	type owner struct {
+		id    int64
+		ident string
+	}
+
+	var private []owner
+	var created int64
+
+	for rows.Next() {
+		var o owner
+		var isPrivate bool
+		var ident sql.NullString
+
+		err = rows.Scan(&o.id, &isPrivate, &ident, &created)
+		if err != nil {
+			return false, false, 0, err
+		}
+
+		if !isPrivate {
+			return true, true, created, nil
+		}
+
+		o.ident = ident.String
+		private = append(private, o)
+	}
+
+	err = rows.Err()
+	if err != nil || len(private) == 0 {
+		return false, false, 0, err
+	}
+
+	ident := r.URL.Query().Get("ident")
+
+	unlocked, err := unlockedModules(r)
+	if err != nil {
+		return false, false, 0, err
+	}
+
+	for _, o := range private {
+		if len(ident) > 0 && o.ident == ident {
+			return true, false, created, nil
+		}
+
+		for _, id := range unlocked {
+			if id == o.id {
+				return true, false, created, nil
+			}
+		}
+	}
+
+	return false, false, 0, nil
+}
+
+// handlePackage serves train module package, Range requests are supported so
+// clients can resume interrupted downloads
+func handlePackage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+
+	hash := strings.TrimSuffix(name, packageExt)
+	if len(hash) != 64 || hash+packageExt != name || strings.Trim(hash, "0123456789abcdef") != "" {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	allowed, public, created, err := packageAllowed(r, hash)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !allowed {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	f, err := os.Open(blobPath(hash))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer f.Close()
+
+	// content addressed, never changes, shared caches must not keep private ones
+	w.Header().Set("ETag", `"`+hash+`"`)
+	if public {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	}
+	w.Header().Set("Content-Type", "application/zip")
+
+	http.ServeContent(w, r, name, time.Unix(created, 0), f)
+}
+
+// moduleVersionHashes returns distinct package hashes in module version history
+func moduleVersionHashes(tx *sql.Tx, moduleID int64) ([]string, error) {
+	rows, err := tx.Query(`SELECT DISTINCT packageHash FROM train_module_version WHERE moduleId = ?`, moduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make([]string, 0)
+
+	for rows.Next() {
+		var hash string
+
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
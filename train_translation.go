@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TrainModuleTranslation is module name and description in one language
+type TrainModuleTranslation struct {
+	Language    string `json:"language"`
+	Name        string `json:"name" valid:"required,length(1|255)"`
+	Description string `json:"description,omitempty" valid:"length(0|4096)"`
+}
+
+func handleAdminListTranslations(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	rows, err := DB.Query(`
+		SELECT
+			lang, name, description
+		FROM
+			train_module_translation
+		WHERE
+			moduleId = ?
+		ORDER BY lang`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	translations := make([]TrainModuleTranslation, 0)
+
+	for rows.Next() {
+		var translation TrainModuleTranslation
+		var description sql.NullString
+
+		err = rows.Scan(&translation.Language, &translation.Name, &description)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		translation.Description = description.String
+
+		translations = append(translations, translation)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(translations)
+}
+
+func handleAdminPutTranslation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	lang := normalizeLanguage(ps.ByName("lang"))
+	if !ok || len(lang) == 0 {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	_, err := getAdminTrainModule(id)
+	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	translation := &TrainModuleTranslation{}
+	_, status, err := decodeJSONBody(w, r, Config.MaxAdminBodyBytes, translation)
+	if err != nil {
+		writeBodyError(w, status, err)
+		return
+	}
+	translation.Language = lang
+
+	if !validateStruct(w, "TrainModuleTranslation", translation) {
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO train_module_translation (
+			moduleId, lang, name, description
+		) VALUES (
+			?, ?, ?, ?
+		)
+		ON DUPLICATE KEY UPDATE
+			name = VALUES(name), description = VALUES(description)`,
+		id, lang, translation.Name, nullString(translation.Description))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "translate", "train_module", id, translation)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(translation)
+}
+
+func handleAdminDeleteTranslation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	lang := normalizeLanguage(ps.ByName("lang"))
+	if !ok || len(lang) == 0 {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM train_module_translation WHERE moduleId = ? AND lang = ?`, id, lang)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if ra == 0 {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	err = audit(tx, r, "delete_translation", "train_module", id, map[string]string{"language": lang})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	invalidateModuleCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
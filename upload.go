@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -23,7 +22,7 @@ func handleUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 
 	// validate parameters
 	if !govalidator.IsUUID(name) {
-		w.WriteHeader(400)
+		writeError(w, 400, ErrCodeBadRequest, nil)
 		return
 	}
 
@@ -31,35 +30,26 @@ func handleUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	uploaded, err := isEvidenceUploded(name)
 	if err != nil {
 		log.Println("Error opening file", err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
 	if uploaded {
 		logNetPrintf(r, "Uploading uploaded evidence %s\n", name)
-		w.WriteHeader(403)
+		writeError(w, 403, ErrCodeUploadClosed, nil)
 		return
 	}
 
-	out, err := os.OpenFile(path.Join(Config.BaseDir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	reportIDs, err := evidenceReports(name)
 	if err != nil {
-		log.Println("Error opening file", err)
-		w.WriteHeader(500)
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, r.Body)
-	if err != nil {
-		log.Println("Error writing to file", err)
-		w.WriteHeader(500)
+		log.Println(err)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
-	err = out.Sync()
+	err = appendUpload(r, name, reportIDs)
 	if err != nil {
-		log.Println("Error syncing file", err)
-		w.WriteHeader(500)
+		writeUploadError(w, err)
 		return
 	}
 
@@ -71,18 +61,18 @@ func handleInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	// validate parameters
 	if !govalidator.IsUUID(name) {
-		w.WriteHeader(400)
+		writeError(w, 400, ErrCodeBadRequest, nil)
 		return
 	}
 
 	stat, err := os.Stat(path.Join(Config.BaseDir, name))
 	if err != nil {
 		if os.IsNotExist(err) {
-			w.WriteHeader(404)
+			writeError(w, 404, ErrCodeNotFound, nil)
 			return
 		}
 		log.Println("Error on file stat", err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
@@ -100,26 +90,32 @@ func handleDone(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	// validate parameters
 	if !govalidator.IsUUID(name) {
-		w.WriteHeader(400)
+		writeError(w, 400, ErrCodeBadRequest, nil)
 		return
 	}
 
-	result, err := DB.Exec(`UPDATE evidence SET state = ? WHERE uid = ?`, 20, name)
+	// check evidence exists before touching storage
+	_, err := getEvidence(name)
 	if err != nil {
+		if err == NotFound {
+			writeError(w, 404, ErrCodeNotFound, nil) // harvesting possible
+			return
+		}
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
-	ra, err := result.RowsAffected()
+	// move file to blob storage, collapsing it with identical uploads
+	ra, err := completeUpload("evidence", name, 20)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		writeError(w, 500, ErrCodeInternal, nil)
 		return
 	}
 
 	if ra == 0 {
-		w.WriteHeader(404) // harvesting possible
+		writeError(w, 404, ErrCodeNotFound, nil) // harvesting possible
 		return
 	}
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// uploadBlob is uploaded file uid with blob it was stored as, if any
+type uploadBlob struct {
+	uid  string
+	hash sql.NullString
+}
+
+// removeUploads removes files and releases blobs of uploads whose rows were deleted,
+// shared files and blobs stay while other rows reference them
+func removeUploads(uploads []uploadBlob) {
+	for _, u := range uploads {
+		err := removeUpload(u.uid)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if u.hash.Valid {
+			releaseBlobs(u.hash.String)
+		}
+	}
+}
+
+func handleAdminDeleteReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := paramID(ps)
+	if !ok {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT uid, blobHash FROM evidence WHERE reportId = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	uploads := make([]uploadBlob, 0)
+
+	for rows.Next() {
+		var u uploadBlob
+
+		err = rows.Scan(&u.uid, &u.hash)
+		if err != nil {
+			rows.Close()
+			writeInternalError(w, err)
+			return
+		}
+
+		uploads = append(uploads, u)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	result, err := tx.Exec(`DELETE FROM report WHERE id = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if ra == 0 {
+		writeError(w, 404, ErrCodeNotFound, nil)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM evidence WHERE reportId = ?`, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "delete", "report", id, nil)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	removeUploads(uploads)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAdminDeleteMediaFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	uid := ps.ByName("uid")
+
+	if !govalidator.IsUUID(uid) {
+		writeError(w, 400, ErrCodeBadRequest, nil)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var mediaID int64
+	u := uploadBlob{uid: uid}
+
+	row := tx.QueryRow(`SELECT id, blobHash FROM media_file WHERE uid = ? FOR UPDATE`, uid)
+	err = row.Scan(&mediaID, &u.hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, 404, ErrCodeNotFound, nil)
+			return
+		}
+		writeInternalError(w, err)
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM media_file WHERE uid = ?`, uid)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = audit(tx, r, "delete", "media_file", mediaID, map[string]string{"uid": uid})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	removeUploads([]uploadBlob{u})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,7 +4,9 @@ import (
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 )
@@ -19,7 +21,19 @@ func init() {
 			"mpeg4": true,
 		}
 
-		rxWhistlerCells = regexp.MustCompile("^[0-9a-zA-Z:, -]+$")
+		rxWhistlerCells      = regexp.MustCompile("^[0-9a-zA-Z:, -]+$")
+		rxWhistlerBSSID      = regexp.MustCompile("^([0-9a-fA-F]{2}[:-]){5}[0-9a-fA-F]{2}$")
+		rxWhistlerScreenshot = regexp.MustCompile(`^[0-9a-zA-Z_ -][0-9a-zA-Z_. -]{0,95}\.(?i:jpe?g|png)$`)
+
+		feedbackCategories = map[string]bool{
+			FeedbackCategoryBug:      true,
+			FeedbackCategoryAbuse:    true,
+			FeedbackCategorySecurity: true,
+			FeedbackCategoryOther:    true,
+		}
+
+		// metadata timestamps before this are from misconfigured phones
+		minTimestamp = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
 	)
 
 	govalidator.TagMap["whistlerfile"] = govalidator.Validator(func(str string) bool {
@@ -53,47 +67,98 @@ func init() {
 		}
 		return rxWhistlerCells.MatchString(str)
 	})
-}
 
-func validateStruct(w http.ResponseWriter, name string, s interface{}) bool {
-	vres, err := govalidator.ValidateStruct(s)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(400)
-		return false
-	}
+	govalidator.TagMap["whistlerbssid"] = govalidator.Validator(func(str string) bool {
+		if govalidator.IsNull(str) {
+			return true
+		}
+		return rxWhistlerBSSID.MatchString(str)
+	})
 
-	if !vres {
-		log.Printf("ValidateStruct for %s returned false\n", name)
-		w.WriteHeader(400)
-		return false
-	}
+	// govalidator runs tag validators of []string field on its first element only
+	govalidator.CustomTypeTagMap.Set("whistlercellslist", stringsValidator(govalidator.TagMap["whistlercells"]))
+	govalidator.CustomTypeTagMap.Set("whistlerbssidlist", stringsValidator(govalidator.TagMap["whistlerbssid"]))
 
-	return true
-}
+	govalidator.TagMap["whistlerlang"] = govalidator.Validator(func(str string) bool {
+		if govalidator.IsNull(str) {
+			return true
+		}
+		return normalizeLanguage(str) == str
+	})
 
-func validateMetadata(w http.ResponseWriter, name string, m Metadata) bool {
-	if !validateStruct(w, name, m) {
-		return false
-	}
+	govalidator.TagMap["whistlerscreenshot"] = govalidator.Validator(func(str string) bool {
+		if govalidator.IsNull(str) {
+			return true
+		}
+		return rxWhistlerScreenshot.MatchString(str)
+	})
 
-	for _, cell := range m.Cells {
-		if !govalidator.TagMap["whistlercells"](cell) {
-			log.Printf("%s does not validate as whistlercells\n", cell)
-			w.WriteHeader(400)
+	govalidator.TagMap["whistlercategory"] = govalidator.Validator(func(str string) bool {
+		if govalidator.IsNull(str) {
+			return true
+		}
+		return feedbackCategories[str]
+	})
+
+	govalidator.TagMap["whistlerlatitude"] = floatRangeValidator(-90, 90)
+	govalidator.TagMap["whistlerlongitude"] = floatRangeValidator(-180, 180)
+	govalidator.TagMap["whistleraccuracy"] = floatRangeValidator(0, 1e7) // meters
+
+	govalidator.TagMap["whistlertimestamp"] = govalidator.Validator(func(str string) bool {
+		ts, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
 			return false
 		}
-	}
 
-	return true
+		// android sends milliseconds, but accept seconds too
+		if ts > 1e11 {
+			ts = ts / 1000
+		}
+
+		// allow a day of clock skew
+		return ts >= minTimestamp && ts <= time.Now().Add(24*time.Hour).Unix()
+	})
 }
 
-func validateMediafile(w http.ResponseWriter, name string, mediaFile MediaFile) bool {
-	if !validateStruct(w, name, mediaFile) {
+// stringsValidator returns validator of []string field checking every element with v
+func stringsValidator(v govalidator.Validator) govalidator.CustomTypeValidator {
+	return govalidator.CustomTypeValidator(func(i interface{}, o interface{}) bool {
+		strs, ok := i.([]string)
+		if !ok {
+			return false
+		}
+
+		for _, str := range strs {
+			if !v(str) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// floatRangeValidator returns validator accepting numbers in [min, max]
+func floatRangeValidator(min float64, max float64) govalidator.Validator {
+	return govalidator.Validator(func(str string) bool {
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return false
+		}
+		return f >= min && f <= max
+	})
+}
+
+func validateStruct(w http.ResponseWriter, name string, s interface{}) bool {
+	vres, err := govalidator.ValidateStruct(s)
+	if err != nil {
+		log.Println(err.Error())
+		writeError(w, 400, ErrCodeValidation, validationFields(s))
 		return false
 	}
 
-	if !validateMetadata(w, name+".Metadata", mediaFile.Metadata) {
+	if !vres {
+		log.Printf("ValidateStruct for %s returned false\n", name)
+		writeError(w, 400, ErrCodeValidation, nil)
 		return false
 	}
 
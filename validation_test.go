@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestValidationFieldsMetadataLists(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata Metadata
+		field    string
+	}{
+		{"valid", Metadata{Cells: []string{"310 260 1234", "310 260 5678"}, Wifis: []string{"00:11:22:33:44:55", "66-77-88-99-aa-bb"}}, ""},
+		{"first cell", Metadata{Cells: []string{"<script>", "310 260 1234"}}, "evidences.0.metadata.cells"},
+		{"second cell", Metadata{Cells: []string{"310 260 1234", "<script>"}}, "evidences.0.metadata.cells"},
+		{"first wifi", Metadata{Wifis: []string{"not a bssid", "00:11:22:33:44:55"}}, "evidences.0.metadata.wifis"},
+		{"second wifi", Metadata{Wifis: []string{"00:11:22:33:44:55", "not a bssid"}}, "evidences.0.metadata.wifis"},
+	}
+
+	for _, test := range tests {
+		report := &Report{
+			Evidences:  []Evidence{{Metadata: test.metadata}},
+			Recipients: []Recipient{{Title: "Editor"}},
+		}
+
+		fields := validationFields(report)
+
+		if len(test.field) == 0 {
+			if fields != nil {
+				t.Errorf("%s: expected no fields, got %v", test.name, fields)
+			}
+			continue
+		}
+
+		if _, ok := fields[test.field]; !ok || len(fields) != 1 {
+			t.Errorf("%s: expected only %q, got %v", test.name, test.field, fields)
+		}
+	}
+}
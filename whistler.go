@@ -34,14 +34,60 @@ func getEvidence(uid string) (*Evidence, error) {
 
 // WhistlerConfig struct defines config params
 type WhistlerConfig struct {
+	ListenAddr            string `env:"LISTEN_ADDR" default:"127.0.0.1:9000"`
 	DataSourceName        string `env:"DATASOURCE_NAME" required:"true"`
 	BaseDir               string `env:"BASE_DIR" required:"true"`
 	ModuleBaseURL         string `env:"TRAIN_MODLUE_BASE_URL" required:"true"`
-	FeedbackMailTo        string `env:"FM_TO" required:"true"`
-	FeedbackMailSubject   string `env:"FM_SUBJECT" required:"true"`
-	FeedbackMailSMTPHost  string `env:"FM_SMTP_HOST" required:"true"`
-	FeedbackMailSMTPPort  int    `env:"FM_SMTP_PORT" required:"true"`
-	FeedbackMailLocalHost string `env:"FM_LOCAL_HOST" required:"true"`
+	FeedbackMailTo        string `env:"FM_TO"`
+	FeedbackMailSubject   string `env:"FM_SUBJECT" default:"Whistler feedback"`
+	FeedbackMailSMTPHost  string `env:"FM_SMTP_HOST"`
+	FeedbackMailSMTPPort  int    `env:"FM_SMTP_PORT"`
+	FeedbackMailLocalHost string `env:"FM_LOCAL_HOST"`
+	AdminToken            string `env:"ADMIN_TOKEN"`
+	QuotaUIDBytes         int64  `env:"QUOTA_UID_BYTES"`
+	QuotaReportBytes      int64  `env:"QUOTA_REPORT_BYTES"`
+	QuotaDeviceBytes      int64  `env:"QUOTA_DEVICE_BYTES"`
+	MinFreeBytes          int64  `env:"MIN_FREE_BYTES"`
+	// request body limits
+	MaxReportBodyBytes       int64 `env:"MAX_REPORT_BODY_BYTES" default:"1048576"`
+	MaxRegistrationBodyBytes int64 `env:"MAX_REGISTRATION_BODY_BYTES" default:"1048576"`
+	MaxFeedbackBodyBytes     int64 `env:"MAX_FEEDBACK_BODY_BYTES" default:"2097152"`
+	MaxAdminBodyBytes        int64 `env:"MAX_ADMIN_BODY_BYTES" default:"65536"`
+	MaxModulePackageBytes    int64 `env:"MAX_MODULE_PACKAGE_BYTES" default:"536870912"`
+	ModuleCacheTTL           int64 `env:"MODULE_CACHE_TTL" default:"60"`
+	FeedbackMaxAttempts      int   `env:"FM_MAX_ATTEMPTS" default:"20"`
+	// feedback delivery
+	FeedbackSinks          []string `env:"FEEDBACK_SINKS" default:"smtp"`
+	FeedbackWebhookURL     string   `env:"FEEDBACK_WEBHOOK_URL"`
+	FeedbackWebhookSecret  string   `env:"FEEDBACK_WEBHOOK_SECRET"`
+	FeedbackChatWebhookURL string   `env:"FEEDBACK_CHAT_WEBHOOK_URL"`
+	// feedback mail
+	FeedbackMailFrom         string `env:"FM_FROM"`
+	FeedbackMailTLS          string `env:"FM_SMTP_TLS" default:"starttls"`
+	FeedbackMailCAFile       string `env:"FM_SMTP_CA_FILE"`
+	FeedbackMailAuth         string `env:"FM_SMTP_AUTH" default:"none"`
+	FeedbackMailUser         string `env:"FM_SMTP_USER"`
+	FeedbackMailPassword     string `env:"FM_SMTP_PASSWORD"`
+	FeedbackMailTokenFile    string `env:"FM_SMTP_TOKEN_FILE"`
+	FeedbackMailDKIMDomain   string `env:"FM_DKIM_DOMAIN"`
+	FeedbackMailDKIMSelector string `env:"FM_DKIM_SELECTOR"`
+	FeedbackMailDKIMKeyFile  string `env:"FM_DKIM_KEY_FILE"`
+	// feedback abuse protection
+	FeedbackIPRate           int      `env:"FEEDBACK_IP_RATE" default:"10"`
+	FeedbackDeviceRate       int      `env:"FEEDBACK_DEVICE_RATE" default:"5"`
+	TrustedProxies           []string `env:"TRUSTED_PROXIES"`
+	FeedbackPoWDifficulty    int      `env:"FEEDBACK_POW_DIFFICULTY" default:"0"`
+	FeedbackMaxLinks         int      `env:"FEEDBACK_MAX_LINKS" default:"3"`
+	FeedbackMaxMessageLength int      `env:"FEEDBACK_MAX_MESSAGE_LENGTH" default:"10000"`
+	FeedbackDuplicateWindow  int64    `env:"FEEDBACK_DUPLICATE_WINDOW" default:"86400"`
+	// feedback attachments
+	FeedbackMaxAttachments     int   `env:"FEEDBACK_MAX_ATTACHMENTS" default:"2"`
+	FeedbackMaxAttachmentBytes int64 `env:"FEEDBACK_MAX_ATTACHMENT_BYTES" default:"524288"`
+	JSONDisallowUnknownFields  bool  `env:"JSON_DISALLOW_UNKNOWN_FIELDS"`
+	// reflector
+	ReflectorSecret  string `env:"REFLECTOR_FORWARD_SECRET"`
+	ReflectorWindow  int64  `env:"REFLECTOR_FORWARD_WINDOW" default:"300"`
+	RequireReflector bool   `env:"REQUIRE_REFLECTOR"`
 }
 
 // Config holds config parameters from env
@@ -68,13 +114,33 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = configureFeedbackSinks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startFeedbackSender()
+
+	err = configureFeedbackAbuse()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = configureReflectorTrust()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	router := httprouter.New()
 
 	// rest
 	router.POST("/rest/v1/reports", handleCreateReport)
 	router.POST("/rest/v1/media/forms/registrations", handleRegisterFormMediaFiles)
 	router.GET("/rest/v1/train/modules", handleListModules)
+	router.GET("/rest/v1/train/modules/updates", handleModuleUpdates)
+	router.POST("/rest/v1/train/invites/redeem", handleRedeemInvite)
 	router.POST("/rest/v1/feedback/messages", handleFeedback)
+	router.GET("/rest/v1/feedback/messages/:uid", handleFeedbackStatus)
+	router.GET("/rest/v1/feedback/challenge", handleFeedbackChallenge)
 	// upload
 	router.POST("/files/:name", handleUpload)
 	router.POST("/files/:name/done", handleDone)
@@ -83,6 +149,35 @@ func main() {
 	router.POST("/media/:uid", handleMediaUpload)
 	router.POST("/media/:uid/done", handleMediaDone)
 	router.GET("/media/:uid/info", handleMediaInfo)
-
-	log.Fatal(http.ListenAndServe("127.0.0.1:9000", router))
+	// admin
+	router.GET("/admin/v1/quotas", requireAdmin(handleQuotaUsage))
+	router.DELETE("/admin/v1/reports/:id", requireAdmin(handleAdminDeleteReport))
+	router.DELETE("/admin/v1/media/:uid", requireAdmin(handleAdminDeleteMediaFile))
+	router.GET("/admin/v1/train/organizations", requireAdmin(handleAdminListOrganizations))
+	router.POST("/admin/v1/train/organizations", requireAdmin(handleAdminCreateOrganization))
+	router.PUT("/admin/v1/train/organizations/:id", requireAdmin(handleAdminUpdateOrganization))
+	router.DELETE("/admin/v1/train/organizations/:id", requireAdmin(handleAdminDeleteOrganization))
+	router.GET("/admin/v1/train/modules", requireAdmin(handleAdminListModules))
+	router.POST("/admin/v1/train/modules", requireAdmin(handleAdminCreateModule))
+	router.GET("/admin/v1/train/modules/:id", requireAdmin(handleAdminGetModule))
+	router.PUT("/admin/v1/train/modules/:id", requireAdmin(handleAdminUpdateModule))
+	router.DELETE("/admin/v1/train/modules/:id", requireAdmin(handleAdminDeleteModule))
+	router.POST("/admin/v1/train/modules/:id/publish", requireAdmin(setModulePublished(true)))
+	router.POST("/admin/v1/train/modules/:id/unpublish", requireAdmin(setModulePublished(false)))
+	router.PUT("/admin/v1/train/modules/:id/package", requireAdmin(handleAdminUploadPackage))
+	router.GET("/admin/v1/train/modules/:id/translations", requireAdmin(handleAdminListTranslations))
+	router.PUT("/admin/v1/train/modules/:id/translations/:lang", requireAdmin(handleAdminPutTranslation))
+	router.DELETE("/admin/v1/train/modules/:id/translations/:lang", requireAdmin(handleAdminDeleteTranslation))
+	router.GET("/admin/v1/train/invites", requireAdmin(handleAdminListInvites))
+	router.POST("/admin/v1/train/invites", requireAdmin(handleAdminCreateInvite))
+	router.DELETE("/admin/v1/train/invites/:id", requireAdmin(handleAdminRevokeInvite))
+	router.GET("/admin/v1/feedback", requireAdmin(handleAdminListFeedback))
+	router.PUT("/admin/v1/feedback/:id/handled", requireAdmin(setFeedbackHandled(true)))
+	router.DELETE("/admin/v1/feedback/:id/handled", requireAdmin(setFeedbackHandled(false)))
+	router.GET("/admin/v1/feedback/:id/attachments/:name", requireAdmin(handleAdminFeedbackAttachment))
+	// train module packages
+	router.GET("/train/packages/:name", handlePackage)
+	router.HEAD("/train/packages/:name", handlePackage)
+
+	log.Fatal(http.ListenAndServe(Config.ListenAddr, trustReflector(router)))
 }